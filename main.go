@@ -6,13 +6,19 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/africhild/fleet-infra/src/application"
 	"github.com/africhild/fleet-infra/src/common"
 	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/git"
 	"github.com/africhild/fleet-infra/src/infrastructure"
 	"github.com/africhild/fleet-infra/src/ingress"
+	"github.com/africhild/fleet-infra/src/inventory"
+	"github.com/africhild/fleet-infra/src/lint"
+	"github.com/africhild/fleet-infra/src/render"
 	"github.com/africhild/fleet-infra/src/secret"
+	"github.com/africhild/fleet-infra/src/validate"
 	"github.com/spf13/cobra"
 )
 
@@ -36,10 +42,47 @@ func main() {
 	genSecretCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
 	genSecretCmd.Flags().StringP("file", "f", "", "Path to the .env file")
 	genSecretCmd.Flags().StringP("app", "a", "", "Application name")
+	genSecretCmd.Flags().StringP("name", "n", "", "Secret name (default <app>.<env>.secret)")
+	genSecretCmd.Flags().StringSliceP("container", "c", nil, "Containers to inject the secret into (default first container)")
 	genSecretCmd.MarkFlagRequired("env")
 	genSecretCmd.MarkFlagRequired("file")
 	genSecretCmd.MarkFlagRequired("app")
 
+	var secretStatusCmd = &cobra.Command{
+		Use:   "secret:status",
+		Short: "Report drift between sealed secrets, deployments and a local .env",
+		Run:   secretStatus,
+	}
+	secretStatusCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	secretStatusCmd.Flags().StringP("app", "a", "", "Application name")
+	secretStatusCmd.Flags().StringP("file", "f", "", "Path to a local .env file to compare (optional)")
+	secretStatusCmd.Flags().StringP("name", "n", "", "Compare the .env file with this secret only")
+	secretStatusCmd.MarkFlagRequired("env")
+	secretStatusCmd.MarkFlagRequired("app")
+
+	var resealCmd = &cobra.Command{
+		Use:   "secret:reseal",
+		Short: "Re-encrypt every sealed secret after the sealing certificate rotated",
+		Run:   resealSecrets,
+	}
+	resealCmd.Flags().StringP("cert", "", "", "Path to the new sealing certificate")
+	resealCmd.Flags().StringP("env", "e", "", "Only reseal secrets of this environment")
+	resealCmd.Flags().StringP("plaintext", "p", "", "Directory with <secret-name>.env files to seal in-process")
+	resealCmd.MarkFlagRequired("cert")
+
+	var certCmd = &cobra.Command{
+		Use:   "secret:cert",
+		Short: "Manage the sealing certificates of the environments",
+	}
+	var fetchCertCmd = &cobra.Command{
+		Use:   "fetch",
+		Short: "Fetch the sealing certificate of an environment's controller",
+		Run:   fetchCert,
+	}
+	fetchCertCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	fetchCertCmd.MarkFlagRequired("env")
+	certCmd.AddCommand(fetchCertCmd)
+
 	var createNewAppCmd = &cobra.Command{
 		Use:   "app:create",
 		Short: "Create a new application",
@@ -49,9 +92,239 @@ func main() {
 	createNewAppCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
 	createNewAppCmd.Flags().IntP("port", "p", 80, "Port")
 	createNewAppCmd.Flags().IntP("replicas", "r", 1, "Number of replicas")
+	createNewAppCmd.Flags().StringP("kind", "k", application.KindWeb, "Kind of application ("+strings.Join(application.Kinds, "|")+")")
+	createNewAppCmd.Flags().StringP("schedule", "", "", "Cron schedule (cronjob only)")
+	createNewAppCmd.Flags().StringP("autoscale", "", "", "Autoscale with min:max:cpu% instead of a fixed replica count")
+	createNewAppCmd.Flags().BoolP("pdb", "", false, "Add a PodDisruptionBudget")
+	createNewAppCmd.Flags().StringArrayP("sidecar", "", nil, "Sidecar container as name=image (repeatable)")
+	createNewAppCmd.Flags().StringArrayP("init-container", "", nil, "Init container as name=image (repeatable)")
+	createNewAppCmd.Flags().StringP("tag", "t", "latest", "Image tag")
+	createNewAppCmd.Flags().BoolP("image-automation", "", false, "Let Flux update the image tag from the registry")
+	createNewAppCmd.Flags().StringP("image-policy", "", "timestamp", "Tag selection of the image automation (timestamp|semver:<range>)")
+	createNewAppCmd.Flags().StringP("storage-size", "", "1Gi", "Volume size per replica (statefulset only)")
+	createNewAppCmd.Flags().StringP("readiness-path", "", "", "HTTP path of the readiness probe")
+	createNewAppCmd.Flags().StringP("liveness-path", "", "", "HTTP path of the liveness probe")
+	createNewAppCmd.Flags().StringP("cpu-request", "", "", "CPU request (e.g. 100m)")
+	createNewAppCmd.Flags().StringP("memory-request", "", "", "Memory request (e.g. 128Mi)")
+	createNewAppCmd.Flags().StringP("cpu-limit", "", "", "CPU limit (e.g. 500m)")
+	createNewAppCmd.Flags().StringP("memory-limit", "", "", "Memory limit (e.g. 256Mi)")
+	createNewAppCmd.Flags().BoolP("run-as-non-root", "", false, "Require the containers to run as a non-root user")
+	createNewAppCmd.Flags().BoolP("read-only-root-fs", "", false, "Mount the container root filesystem read-only")
 	createNewAppCmd.MarkFlagRequired("app")
 	createNewAppCmd.MarkFlagRequired("env")
-	createNewAppCmd.MarkFlagRequired("port")
+
+	var updateAppCmd = &cobra.Command{
+		Use:   "app:update",
+		Short: "Change the settings of an existing application",
+		Run:   updateApp,
+	}
+	updateAppCmd.Flags().StringP("app", "a", "", "Application name")
+	updateAppCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	updateAppCmd.Flags().IntP("replicas", "r", 0, "Number of replicas")
+	updateAppCmd.Flags().StringP("image", "i", "", "Container image")
+	updateAppCmd.Flags().IntP("port", "p", 0, "Container port")
+	updateAppCmd.Flags().StringP("container", "c", "", "Container receiving --image (default the app's main container)")
+	updateAppCmd.MarkFlagRequired("app")
+	updateAppCmd.MarkFlagRequired("env")
+
+	var applyCmd = &cobra.Command{
+		Use:   "apply",
+		Short: "Create or update an application from its spec file",
+		Run:   applySpec,
+	}
+	applyCmd.Flags().StringP("file", "f", application.SpecFile, "Path to the app spec")
+
+	var planCmd = &cobra.Command{
+		Use:   "plan",
+		Short: "Show what applying the app specs would change, exit code 2 when there is drift",
+		Run:   planSpecs,
+	}
+	planCmd.Flags().StringSliceP("file", "f", nil, "App specs to plan (default every fleet-app.yaml in the repository)")
+
+	var validateCmd = &cobra.Command{
+		Use:   "validate [path]",
+		Short: "Check the manifests under apps, infrastructure and clusters against the bundled schemas",
+		Long: `Check the manifests under apps, infrastructure and clusters against the bundled schemas.
+
+The schemas are a subset of the upstream OpenAPI schemas and Flux and
+SealedSecret CRDs. Kinds without a schema are reported as warnings. Run with
+--schemas to list every field that is checked.`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  validateManifests,
+	}
+	validateCmd.Flags().BoolP("schemas", "", false, "List the bundled kinds and the fields checked for each instead of validating")
+
+	var renderCmd = &cobra.Command{
+		Use:   "render",
+		Short: "Print the manifests the overlays of an environment render to",
+		Run:   renderManifests,
+	}
+	renderCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	renderCmd.Flags().StringP("app", "a", "", "Render only this application")
+	renderCmd.Flags().StringP("output", "o", "", "Write the manifests to this file instead of stdout")
+	renderCmd.MarkFlagRequired("env")
+
+	var lintCmd = &cobra.Command{
+		Use:   "lint",
+		Short: "Check the rendered manifests against the built-in and custom policy rules",
+		Run:   lintManifests,
+	}
+	lintCmd.Flags().StringSliceP("env", "e", nil, "Environments to lint (default every environment under apps)")
+	lintCmd.Flags().BoolP("list-rules", "", false, "List the rules and their default severity")
+
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the apps, environments, hosts, ports or secrets of the repository",
+		// without Run cobra prints the help for unknown kinds and exits 0
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	listCmd.PersistentFlags().StringP("output", "o", inventory.FormatTable, "Output format (table|json|yaml)")
+	for _, name := range inventory.Lists {
+		listCmd.AddCommand(&cobra.Command{
+			Use:   name,
+			Short: "List the " + name + " of the repository",
+			Run:   listInventory,
+		})
+	}
+
+	var createEnvCmd = &cobra.Command{
+		Use:   "env:create",
+		Short: "Scaffold an environment and the Flux Kustomization applying it",
+		Run:   createEnv,
+	}
+	createEnvCmd.Flags().StringP("name", "n", "", "Environment name, also its namespace")
+	createEnvCmd.Flags().StringP("domain", "d", "", "Domain of the environment's ingress hosts, required unless fleet.yaml sets it")
+	createEnvCmd.Flags().StringP("cluster", "c", "", "Directory under clusters Flux bootstraps the cluster from")
+	createEnvCmd.Flags().StringP("branch", "b", "", "Branch Flux syncs the environment from (default main)")
+	createEnvCmd.Flags().StringP("secret-backend", "", "", "Secret backend ("+config.SealedSecretsBackend+"|"+config.SopsAgeBackend+") (default "+config.SealedSecretsBackend+")")
+	createEnvCmd.Flags().StringSliceP("age-recipient", "", nil, "Age public key secrets are encrypted for ("+config.SopsAgeBackend+" only)")
+	createEnvCmd.MarkFlagRequired("name")
+	createEnvCmd.MarkFlagRequired("cluster")
+
+	var updateEnvCmd = &cobra.Command{
+		Use:   "env:update",
+		Short: "Change the namespace labels, quota and limit range of an environment and render them again",
+		Run:   updateEnv,
+	}
+	updateEnvCmd.Flags().StringP("name", "n", "", "Environment name")
+	updateEnvCmd.MarkFlagRequired("name")
+	for _, c := range []*cobra.Command{createEnvCmd, updateEnvCmd} {
+		c.Flags().StringToStringP("label", "l", nil, "Namespace labels as key=value, an empty value removes the label")
+		c.Flags().StringToStringP("quota", "", nil, "ResourceQuota hard limits as resource=quantity, like requests.cpu=4,pods=20")
+		c.Flags().StringToStringP("limit-default", "", nil, "LimitRange container limits as resource=quantity, like memory=256Mi")
+		c.Flags().StringToStringP("limit-default-request", "", nil, "LimitRange container requests as resource=quantity, like cpu=50m")
+		c.Flags().StringToStringP("limit-max", "", nil, "LimitRange container maximums as resource=quantity")
+		c.Flags().StringToStringP("limit-min", "", nil, "LimitRange container minimums as resource=quantity")
+	}
+
+	var deleteEnvCmd = &cobra.Command{
+		Use:   "env:delete",
+		Short: "Remove an environment and the Flux Kustomization applying it",
+		Run:   deleteEnv,
+	}
+	deleteEnvCmd.Flags().StringP("name", "n", "", "Environment name")
+	deleteEnvCmd.Flags().BoolP("force", "", false, "Remove the environment even if it still has apps")
+	deleteEnvCmd.MarkFlagRequired("name")
+
+	var promoteAppCmd = &cobra.Command{
+		Use:   "app:promote",
+		Short: "Copy an application from one environment to another",
+		Run:   promoteApp,
+	}
+	promoteAppCmd.Flags().StringP("app", "a", "", "Application name")
+	promoteAppCmd.Flags().StringP("from", "", "", "Source environment")
+	promoteAppCmd.Flags().StringP("to", "", "", "Target environment")
+	promoteAppCmd.MarkFlagRequired("app")
+	promoteAppCmd.MarkFlagRequired("from")
+	promoteAppCmd.MarkFlagRequired("to")
+
+	var containerCmd = &cobra.Command{
+		Use:   "app:container",
+		Short: "Manage the sidecar and init containers of an application",
+	}
+	var addContainerCmd = &cobra.Command{
+		Use:   "add",
+		Short: "Add a sidecar or init container",
+		Run:   addContainer,
+	}
+	addContainerCmd.Flags().StringP("app", "a", "", "Application name")
+	addContainerCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	addContainerCmd.Flags().StringP("name", "n", "", "Container name")
+	addContainerCmd.Flags().StringP("image", "i", "", "Image reference with a tag or digest")
+	addContainerCmd.Flags().IntP("port", "p", 0, "Container port")
+	addContainerCmd.Flags().StringArrayP("command", "", nil, "Command and arguments (repeatable)")
+	addContainerCmd.Flags().BoolP("init", "", false, "Run as an init container before the app starts")
+	addContainerCmd.MarkFlagRequired("app")
+	addContainerCmd.MarkFlagRequired("env")
+	addContainerCmd.MarkFlagRequired("name")
+	addContainerCmd.MarkFlagRequired("image")
+	var removeContainerCmd = &cobra.Command{
+		Use:   "remove",
+		Short: "Remove a sidecar or init container",
+		Run:   removeContainer,
+	}
+	removeContainerCmd.Flags().StringP("app", "a", "", "Application name")
+	removeContainerCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	removeContainerCmd.Flags().StringP("name", "n", "", "Container name")
+	removeContainerCmd.MarkFlagRequired("app")
+	removeContainerCmd.MarkFlagRequired("env")
+	removeContainerCmd.MarkFlagRequired("name")
+	containerCmd.AddCommand(addContainerCmd, removeContainerCmd)
+
+	var volumeCmd = &cobra.Command{
+		Use:   "app:volume",
+		Short: "Manage the persistent volumes of an application",
+	}
+	var addVolumeCmd = &cobra.Command{
+		Use:   "add",
+		Short: "Attach a persistent volume to an application",
+		Run:   addVolume,
+	}
+	addVolumeCmd.Flags().StringP("app", "a", "", "Application name")
+	addVolumeCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	addVolumeCmd.Flags().StringP("name", "n", "data", "Volume name")
+	addVolumeCmd.Flags().StringP("size", "s", "", "Volume size (e.g. 5Gi)")
+	addVolumeCmd.Flags().StringP("mount", "m", "", "Mount path in the container")
+	addVolumeCmd.Flags().StringP("storage-class", "", "", "Storage class (default the cluster default)")
+	addVolumeCmd.Flags().StringP("access-mode", "", application.ReadWriteOnce, "Access mode (ReadWriteOnce|ReadWriteMany|ReadOnlyMany)")
+	addVolumeCmd.Flags().StringP("container", "c", "", "Container to mount the volume in (default the app's main container)")
+	addVolumeCmd.MarkFlagRequired("app")
+	addVolumeCmd.MarkFlagRequired("env")
+	addVolumeCmd.MarkFlagRequired("size")
+	addVolumeCmd.MarkFlagRequired("mount")
+	volumeCmd.AddCommand(addVolumeCmd)
+
+	var setImageCmd = &cobra.Command{
+		Use:   "image:set",
+		Short: "Set the image of an application's container",
+		Run:   setImage,
+	}
+	setImageCmd.Flags().StringP("app", "a", "", "Application name")
+	setImageCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	setImageCmd.Flags().StringP("image", "i", "", "Image reference with a tag or digest")
+	setImageCmd.Flags().StringP("container", "c", "", "Container name (default the app's main container)")
+	setImageCmd.Flags().BoolP("commit", "", false, "Commit the change with git")
+	setImageCmd.MarkFlagRequired("app")
+	setImageCmd.MarkFlagRequired("env")
+	setImageCmd.MarkFlagRequired("image")
+
+	var setConfigCmd = &cobra.Command{
+		Use:   "config:set",
+		Short: "Generate a ConfigMap from non-secret configuration and inject it into an application",
+		Run:   setConfig,
+	}
+	setConfigCmd.Flags().StringP("app", "a", "", "Application name")
+	setConfigCmd.Flags().StringP("env", "e", "", "Environment (staging|production)")
+	setConfigCmd.Flags().StringP("file", "f", "", "Path to a .env file injected as environment variables")
+	setConfigCmd.Flags().StringSliceP("mount", "m", nil, "Files to mount into the containers (repeatable)")
+	setConfigCmd.Flags().StringP("mount-path", "", "", "Directory the --mount files are mounted at (default /etc/<app>)")
+	setConfigCmd.Flags().StringP("name", "n", "", "ConfigMap name (default <app>-config)")
+	setConfigCmd.Flags().StringSliceP("container", "c", nil, "Containers to inject the config into (default the app's main container)")
+	setConfigCmd.MarkFlagRequired("app")
+	setConfigCmd.MarkFlagRequired("env")
 
 	var updateIngressCmd = &cobra.Command{
 		Use:   "ingress",
@@ -68,7 +341,7 @@ func main() {
 	updateIngressCmd.MarkFlagRequired("app")
 	updateIngressCmd.MarkFlagRequired("subdomain")
 
-	rootCmd.AddCommand(genSecretCmd, createNewAppCmd, updateIngressCmd, newSetupCmd)
+	rootCmd.AddCommand(genSecretCmd, secretStatusCmd, resealCmd, certCmd, createNewAppCmd, updateAppCmd, applyCmd, planCmd, validateCmd, renderCmd, lintCmd, listCmd, createEnvCmd, updateEnvCmd, deleteEnvCmd, promoteAppCmd, containerCmd, volumeCmd, setImageCmd, setConfigCmd, updateIngressCmd, newSetupCmd)
 	err := rootCmd.Execute()
 	if err != nil {
 		fmt.Println("Error executing command:", err)
@@ -88,6 +361,17 @@ func updateIngress(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 	addStatus := add == true
+	if addStatus {
+		templates, err := application.LoadTemplates(config.TemplatePath)
+		if err != nil {
+			fmt.Println("Error loading templates:", err)
+			os.Exit(1)
+		}
+		if err := application.EnsureIngress(templates, env); err != nil {
+			fmt.Println("Error creating ingress:", err)
+			os.Exit(1)
+		}
+	}
 
 	err := ingress.ManageIngressRule(env, appName, subdomain, addStatus)
 	if err != nil {
@@ -102,20 +386,91 @@ func createNewApp(cmd *cobra.Command, args []string) {
 	env, _ := cmd.Flags().GetString("env")
 	port, _ := cmd.Flags().GetInt("port")
 	replicas, _ := cmd.Flags().GetInt("replicas")
+	kind, _ := cmd.Flags().GetString("kind")
+	schedule, _ := cmd.Flags().GetString("schedule")
+	storageSize, _ := cmd.Flags().GetString("storage-size")
+	tag, _ := cmd.Flags().GetString("tag")
+	imageAutomation, _ := cmd.Flags().GetBool("image-automation")
+	imagePolicy, _ := cmd.Flags().GetString("image-policy")
+	autoscale, _ := cmd.Flags().GetString("autoscale")
+	pdb, _ := cmd.Flags().GetBool("pdb")
 
 	fleet_app_path := filepath.Join(config.AppTemplatePath, env)
 	fmt.Println("Creating new app:", fleet_app_path)
-	application := application.App{
-		Name:      appName,
-		Namespace: env,
-		Env:       env,
-		Port:      port,
-		ImageHost: config.ImageHost,
-		Image:     fmt.Sprintf("%s/%s:latest", config.ImageHost, appName),
-		Replicas:  replicas,
-		Templates: application.Templates,
-	}
-	err := application.Create(fleet_app_path)
+	templates, err := application.LoadTemplates(config.TemplatePath)
+	if err != nil {
+		fmt.Println("Error loading templates:", err)
+		os.Exit(1)
+	}
+	app := application.App{
+		Name:        appName,
+		Kind:        kind,
+		Namespace:   env,
+		Env:         env,
+		Port:        port,
+		ImageHost:   config.ImageHost,
+		Image:       fmt.Sprintf("%s/%s:%s", config.ImageHost, appName, tag),
+		Tag:         tag,
+		Replicas:    replicas,
+		Templates:   templates,
+		Schedule:    schedule,
+		StorageSize: storageSize,
+
+		ImageAutomation:  imageAutomation,
+		ImagePolicy:      imagePolicy,
+		DisruptionBudget: pdb,
+	}
+	sidecars, _ := cmd.Flags().GetStringArray("sidecar")
+	initContainers, _ := cmd.Flags().GetStringArray("init-container")
+	for i, specs := range [][]string{sidecars, initContainers} {
+		for _, spec := range specs {
+			container, err := application.ParseContainer(spec, i == 1)
+			if err != nil {
+				fmt.Println("Error parsing container:", err)
+				os.Exit(1)
+			}
+			app.Containers = append(app.Containers, container)
+		}
+	}
+	if autoscale != "" {
+		if cmd.Flags().Changed("replicas") {
+			fmt.Println("Specify either --replicas or --autoscale")
+			os.Exit(1)
+		}
+		app.Autoscale, err = application.ParseAutoscale(autoscale)
+		if err != nil {
+			fmt.Println("Error parsing --autoscale:", err)
+			os.Exit(1)
+		}
+	}
+	app.ReadinessPath, _ = cmd.Flags().GetString("readiness-path")
+	app.LivenessPath, _ = cmd.Flags().GetString("liveness-path")
+	app.Resources.Requests.CPU, _ = cmd.Flags().GetString("cpu-request")
+	app.Resources.Requests.Memory, _ = cmd.Flags().GetString("memory-request")
+	app.Resources.Limits.CPU, _ = cmd.Flags().GetString("cpu-limit")
+	app.Resources.Limits.Memory, _ = cmd.Flags().GetString("memory-limit")
+
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error reading fleet config:", err)
+		os.Exit(1)
+	}
+	environment := fleetConfig.Environment(env)
+	app.ApplyDefaults(environment.AppDefaults)
+	app.GitBranch = environment.GitBranch
+	app.NamespaceSettings = environment.Namespace
+	// explicit flags win over the environment defaults
+	if cmd.Flags().Changed("run-as-non-root") {
+		app.SecurityContext.RunAsNonRoot, _ = cmd.Flags().GetBool("run-as-non-root")
+	}
+	if cmd.Flags().Changed("read-only-root-fs") {
+		app.SecurityContext.ReadOnlyRootFilesystem, _ = cmd.Flags().GetBool("read-only-root-fs")
+	}
+	if app.ExposesPort() && !cmd.Flags().Changed("port") {
+		fmt.Printf("Specify --port for %s apps\n", kind)
+		os.Exit(1)
+	}
+	err = app.Create(fleet_app_path)
 	if err != nil {
 		fmt.Println("Error creating app:", err)
 		os.Exit(1)
@@ -123,19 +478,606 @@ func createNewApp(cmd *cobra.Command, args []string) {
 	fmt.Println("App successfully created:", appName)
 }
 
+func updateApp(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	appName, _ := cmd.Flags().GetString("app")
+	var opts application.UpdateOptions
+	if cmd.Flags().Changed("replicas") {
+		replicas, _ := cmd.Flags().GetInt("replicas")
+		opts.Replicas = &replicas
+	}
+	if cmd.Flags().Changed("image") {
+		image, _ := cmd.Flags().GetString("image")
+		opts.Image = &image
+		opts.Container, _ = cmd.Flags().GetString("container")
+	}
+	if cmd.Flags().Changed("port") {
+		port, _ := cmd.Flags().GetInt("port")
+		opts.Port = &port
+	}
+	if opts == (application.UpdateOptions{}) {
+		fmt.Println("Specify at least one of --replicas, --image or --port")
+		os.Exit(1)
+	}
+
+	changes, err := application.Update(env, appName, opts)
+	if err != nil {
+		fmt.Println("Error updating app:", err)
+		os.Exit(1)
+	}
+	if len(changes) == 0 {
+		fmt.Println("No changes, app is up to date:", appName)
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	fmt.Println("App successfully updated:", appName)
+}
+
+func applySpec(cmd *cobra.Command, args []string) {
+	file, _ := cmd.Flags().GetString("file")
+	spec, err := application.LoadSpec(file)
+	if err != nil {
+		fmt.Println("Error loading app spec:", err)
+		os.Exit(1)
+	}
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error loading fleet config:", err)
+		os.Exit(1)
+	}
+	templates, err := application.LoadTemplates(config.TemplatePath)
+	if err != nil {
+		fmt.Println("Error loading templates:", err)
+		os.Exit(1)
+	}
+
+	result, err := application.Apply(spec, templates, fleetConfig)
+	if err != nil {
+		fmt.Println("Error applying app spec:", err)
+		os.Exit(1)
+	}
+	for _, change := range result.Changes {
+		fmt.Println(change)
+	}
+	for _, note := range result.Notes {
+		fmt.Println("Note:", note)
+	}
+	if len(result.Changes) == 0 {
+		fmt.Println("No changes, app is up to date:", spec.Name)
+		return
+	}
+	fmt.Println("App successfully applied:", spec.Name)
+}
+
+func planSpecs(cmd *cobra.Command, args []string) {
+	files, _ := cmd.Flags().GetStringSlice("file")
+	if len(files) == 0 {
+		found, err := application.FindSpecs(".")
+		if err != nil {
+			fmt.Println("Error finding app specs:", err)
+			os.Exit(1)
+		}
+		files = found
+	}
+	if len(files) == 0 {
+		fmt.Println("Error: no", application.SpecFile, "found")
+		os.Exit(1)
+	}
+	var specs []*application.Spec
+	for _, file := range files {
+		spec, err := application.LoadSpec(file)
+		if err != nil {
+			fmt.Println("Error loading app spec:", err)
+			os.Exit(1)
+		}
+		specs = append(specs, spec)
+	}
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error loading fleet config:", err)
+		os.Exit(1)
+	}
+	templates, err := application.LoadTemplates(config.TemplatePath)
+	if err != nil {
+		fmt.Println("Error loading templates:", err)
+		os.Exit(1)
+	}
+
+	plan, err := application.MakePlan(specs, templates, fleetConfig)
+	if err != nil {
+		fmt.Println("Error planning app specs:", err)
+		os.Exit(1)
+	}
+	if cmd.Flags().Changed("file") {
+		// overlays of the specs left out are not unmanaged
+		plan.Unmanaged = nil
+	}
+	for _, note := range plan.Notes {
+		fmt.Println("Note:", note)
+	}
+	if plan.InSync() {
+		fmt.Println("No changes, the repository matches its app specs.")
+		return
+	}
+	symbols := map[string]string{application.PlanCreate: "+", application.PlanUpdate: "~", application.PlanDelete: "-"}
+	if plan.HasChanges() {
+		fmt.Println("Applying the app specs would perform the following actions:")
+		fmt.Println()
+		for _, file := range plan.Files {
+			fmt.Printf("  %s %s %s\n", symbols[file.Action], file.Action, file.Path)
+			for _, change := range file.Changes {
+				fmt.Println("     ", change.Summary())
+			}
+		}
+		fmt.Println()
+	}
+	if len(plan.Drift) > 0 {
+		fmt.Println("Files that drifted from the templates, apply leaves them as they are:")
+		fmt.Println()
+		for _, file := range plan.Drift {
+			fmt.Printf("  ~ %s\n", file.Path)
+			for _, change := range file.Changes {
+				fmt.Println("     ", change.Summary())
+			}
+		}
+		fmt.Println()
+	}
+	if len(plan.Unmanaged) > 0 {
+		fmt.Println("Overlays no app spec describes, add a spec or remove them:")
+		fmt.Println()
+		for _, overlay := range plan.Unmanaged {
+			fmt.Printf("  ? %s\n", overlay)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Plan: %d to create, %d to update, %d to delete, %d drifted, %d unmanaged.\n", plan.Count(application.PlanCreate), plan.Count(application.PlanUpdate), plan.Count(application.PlanDelete), len(plan.Drift), len(plan.Unmanaged))
+	os.Exit(2)
+}
+
+func validateManifests(cmd *cobra.Command, args []string) {
+	if listSchemas, _ := cmd.Flags().GetBool("schemas"); listSchemas {
+		schemas, err := validate.LoadSchemas()
+		if err != nil {
+			fmt.Println("Error loading schemas:", err)
+			os.Exit(1)
+		}
+		for _, kind := range schemas.Kinds() {
+			fmt.Println(kind)
+			for _, field := range schemas.Fields(kind) {
+				required := ""
+				if field.Required {
+					required = ", required"
+				}
+				fmt.Printf("  %s: %s%s\n", field.Path, field.Type, required)
+			}
+		}
+		return
+	}
+	paths := validate.DefaultPaths()
+	if len(args) == 1 {
+		if _, err := os.Stat(args[0]); err != nil {
+			fmt.Println("Error validating manifests:", err)
+			os.Exit(1)
+		}
+		paths = args
+	}
+
+	result, err := validate.Paths(paths)
+	if err != nil {
+		fmt.Println("Error validating manifests:", err)
+		os.Exit(1)
+	}
+	for _, issue := range result.Issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("Validated %d documents in %d files: %d errors, %d warnings\n", result.Documents, result.Files, result.Errors(), result.Warnings())
+	if result.Errors() > 0 {
+		os.Exit(1)
+	}
+}
+
+func renderManifests(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	appName, _ := cmd.Flags().GetString("app")
+	output, _ := cmd.Flags().GetString("output")
+	dir := filepath.Join(config.AppTemplatePath, env)
+	if appName != "" {
+		dir = filepath.Join(dir, appName)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		fmt.Println("Error rendering manifests:", err)
+		os.Exit(1)
+	}
+
+	manifests, err := render.Environment(config.AppTemplatePath, dir)
+	if err != nil {
+		fmt.Println("Error rendering manifests:", err)
+		os.Exit(1)
+	}
+	if output == "" {
+		fmt.Print(string(manifests))
+		return
+	}
+	if err := os.WriteFile(output, manifests, 0644); err != nil {
+		fmt.Println("Error writing manifests:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Manifests written to", output)
+}
+
+func lintManifests(cmd *cobra.Command, args []string) {
+	envs, _ := cmd.Flags().GetStringSlice("env")
+	listRules, _ := cmd.Flags().GetBool("list-rules")
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error loading fleet config:", err)
+		os.Exit(1)
+	}
+	if listRules {
+		rules, err := lint.Rules(fleetConfig.LintRules)
+		if err != nil {
+			fmt.Println("Error loading lint rules:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%-24s %-10s %-8s %s\n", "RULE", "PRODUCTION", "OTHER", "DESCRIPTION")
+		for _, rule := range rules {
+			fmt.Printf("%-24s %-10s %-8s %s\n", rule.Name, rule.Severity("production"), rule.Severity(""), rule.Description)
+		}
+		return
+	}
+	if len(envs) == 0 {
+		envs, err = lint.Environments()
+		if err != nil {
+			fmt.Println("Error finding environments:", err)
+			os.Exit(1)
+		}
+	}
+
+	result, err := lint.Lint(envs, fleetConfig)
+	if err != nil {
+		fmt.Println("Error linting manifests:", err)
+		os.Exit(1)
+	}
+	for _, finding := range result.Findings {
+		fmt.Println(finding)
+	}
+	fmt.Printf("Linted %d objects: %d errors, %d warnings\n", result.Objects, result.Count(lint.Error), result.Count(lint.Warning))
+	if result.Count(lint.Error) > 0 {
+		os.Exit(1)
+	}
+}
+
+func listInventory(cmd *cobra.Command, args []string) {
+	format, _ := cmd.Flags().GetString("output")
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error loading fleet config:", err)
+		os.Exit(1)
+	}
+
+	value, table, err := inventory.List(cmd.Name(), fleetConfig)
+	if err != nil {
+		fmt.Println("Error listing "+cmd.Name()+":", err)
+		os.Exit(1)
+	}
+	if err := inventory.Print(os.Stdout, format, value, table); err != nil {
+		fmt.Println("Error printing "+cmd.Name()+":", err)
+		os.Exit(1)
+	}
+}
+
+func createEnv(cmd *cobra.Command, args []string) {
+	var options application.EnvironmentOptions
+	options.Name, _ = cmd.Flags().GetString("name")
+	options.Domain, _ = cmd.Flags().GetString("domain")
+	options.Cluster, _ = cmd.Flags().GetString("cluster")
+	options.GitBranch, _ = cmd.Flags().GetString("branch")
+	options.SecretBackend, _ = cmd.Flags().GetString("secret-backend")
+	options.AgeRecipients, _ = cmd.Flags().GetStringSlice("age-recipient")
+	options.Namespace = namespaceChanges(cmd).Apply(config.NamespaceSettings{})
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error loading fleet config:", err)
+		os.Exit(1)
+	}
+	templates, err := application.LoadTemplates(config.TemplatePath)
+	if err != nil {
+		fmt.Println("Error loading templates:", err)
+		os.Exit(1)
+	}
+
+	result, err := application.CreateEnvironment(templates, options, fleetConfig)
+	if err != nil {
+		fmt.Println("Error creating environment:", err)
+		os.Exit(1)
+	}
+	for _, file := range result.Written {
+		fmt.Println("Wrote", file)
+	}
+	for _, note := range result.Notes {
+		fmt.Println("Note:", note)
+	}
+	fmt.Println("Environment successfully created:", options.Name)
+}
+
+func updateEnv(cmd *cobra.Command, args []string) {
+	name, _ := cmd.Flags().GetString("name")
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error loading fleet config:", err)
+		os.Exit(1)
+	}
+	templates, err := application.LoadTemplates(config.TemplatePath)
+	if err != nil {
+		fmt.Println("Error loading templates:", err)
+		os.Exit(1)
+	}
+
+	settings := namespaceChanges(cmd).Apply(fleetConfig.Environment(name).Namespace)
+	result, err := application.UpdateEnvironment(templates, name, settings, fleetConfig)
+	if err != nil {
+		fmt.Println("Error updating environment:", err)
+		os.Exit(1)
+	}
+	for _, file := range result.Written {
+		fmt.Println("Wrote", file)
+	}
+	for _, file := range result.Removed {
+		fmt.Println("Removed", file)
+	}
+	if len(result.Written) == 0 && len(result.Removed) == 0 {
+		fmt.Println("No changes, environment is up to date:", name)
+		return
+	}
+	fmt.Println("Environment successfully updated:", name)
+}
+
+// namespaceChanges reads the namespace flags of env:create and env:update
+func namespaceChanges(cmd *cobra.Command) application.NamespaceChanges {
+	var changes application.NamespaceChanges
+	changes.Labels, _ = cmd.Flags().GetStringToString("label")
+	changes.Quota, _ = cmd.Flags().GetStringToString("quota")
+	changes.LimitDefault, _ = cmd.Flags().GetStringToString("limit-default")
+	changes.LimitDefaultRequest, _ = cmd.Flags().GetStringToString("limit-default-request")
+	changes.LimitMax, _ = cmd.Flags().GetStringToString("limit-max")
+	changes.LimitMin, _ = cmd.Flags().GetStringToString("limit-min")
+	return changes
+}
+
+func deleteEnv(cmd *cobra.Command, args []string) {
+	name, _ := cmd.Flags().GetString("name")
+	force, _ := cmd.Flags().GetBool("force")
+
+	result, err := application.DeleteEnvironment(name, force)
+	if err != nil {
+		fmt.Println("Error deleting environment:", err)
+		os.Exit(1)
+	}
+	for _, file := range result.Removed {
+		fmt.Println("Removed", file)
+	}
+	for _, file := range result.Written {
+		fmt.Println("Updated", file)
+	}
+	for _, note := range result.Notes {
+		fmt.Println("Note:", note)
+	}
+	fmt.Println("Environment successfully deleted:", name)
+}
+
+func addContainer(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	appName, _ := cmd.Flags().GetString("app")
+	var container application.Container
+	container.Name, _ = cmd.Flags().GetString("name")
+	container.Image, _ = cmd.Flags().GetString("image")
+	container.Port, _ = cmd.Flags().GetInt("port")
+	container.Command, _ = cmd.Flags().GetStringArray("command")
+	container.Init, _ = cmd.Flags().GetBool("init")
+
+	changes, err := application.AddContainer(env, appName, container)
+	if err != nil {
+		fmt.Println("Error adding container:", err)
+		os.Exit(1)
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	fmt.Println("Container successfully added:", container.Name)
+}
+
+func removeContainer(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	appName, _ := cmd.Flags().GetString("app")
+	name, _ := cmd.Flags().GetString("name")
+
+	changes, err := application.RemoveContainer(env, appName, name)
+	if err != nil {
+		fmt.Println("Error removing container:", err)
+		os.Exit(1)
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	fmt.Println("Container successfully removed:", name)
+}
+
+func addVolume(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	appName, _ := cmd.Flags().GetString("app")
+	var opts application.VolumeOptions
+	opts.Name, _ = cmd.Flags().GetString("name")
+	opts.Size, _ = cmd.Flags().GetString("size")
+	opts.MountPath, _ = cmd.Flags().GetString("mount")
+	opts.StorageClass, _ = cmd.Flags().GetString("storage-class")
+	opts.AccessMode, _ = cmd.Flags().GetString("access-mode")
+	opts.Container, _ = cmd.Flags().GetString("container")
+
+	changes, err := application.AddVolume(env, appName, opts)
+	if err != nil {
+		fmt.Println("Error adding volume:", err)
+		os.Exit(1)
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	fmt.Println("Volume successfully added:", opts.Name)
+}
+
+func setImage(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	appName, _ := cmd.Flags().GetString("app")
+	image, _ := cmd.Flags().GetString("image")
+	container, _ := cmd.Flags().GetString("container")
+	commit, _ := cmd.Flags().GetBool("commit")
+
+	changes, err := application.Update(env, appName, application.UpdateOptions{Image: &image, Container: container})
+	if err != nil {
+		fmt.Println("Error setting image:", err)
+		os.Exit(1)
+	}
+	if len(changes) == 0 {
+		fmt.Println("Image already set:", image)
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if commit {
+		message := fmt.Sprintf("chore(%s): update %s image to %s", env, appName, image)
+		var files []string
+		seen := make(map[string]bool)
+		for _, change := range changes {
+			if !seen[change.File] {
+				seen[change.File] = true
+				files = append(files, change.File)
+			}
+		}
+		if err := git.Commit(message, files...); err != nil {
+			fmt.Println("Error committing image update:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func setConfig(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	appName, _ := cmd.Flags().GetString("app")
+	var opts application.ConfigOptions
+	opts.EnvFile, _ = cmd.Flags().GetString("file")
+	opts.Files, _ = cmd.Flags().GetStringSlice("mount")
+	opts.MountPath, _ = cmd.Flags().GetString("mount-path")
+	opts.Name, _ = cmd.Flags().GetString("name")
+	opts.Containers, _ = cmd.Flags().GetStringSlice("container")
+	if opts.EnvFile == "" && len(opts.Files) == 0 {
+		fmt.Println("Specify --file, --mount or both")
+		os.Exit(1)
+	}
+
+	changes, err := application.SetConfig(env, appName, opts)
+	if err != nil {
+		fmt.Println("Error setting config:", err)
+		os.Exit(1)
+	}
+	if len(changes) == 0 {
+		fmt.Println("No changes, config is up to date:", appName)
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	fmt.Println("Config successfully set:", appName)
+}
+
+func promoteApp(cmd *cobra.Command, args []string) {
+	appName, _ := cmd.Flags().GetString("app")
+	from, _ := cmd.Flags().GetString("from")
+	to, _ := cmd.Flags().GetString("to")
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error loading fleet config:", err)
+		os.Exit(1)
+	}
+	templates, err := application.LoadTemplates(config.TemplatePath)
+	if err != nil {
+		fmt.Println("Error loading templates:", err)
+		os.Exit(1)
+	}
+
+	result, err := application.Promote(templates, appName, from, to, fleetConfig)
+	if err != nil {
+		fmt.Println("Error promoting app:", err)
+		os.Exit(1)
+	}
+	for _, file := range result.Files {
+		fmt.Println("Created", file)
+	}
+	if result.Image != "" {
+		fmt.Println("Image:", result.Image)
+	}
+	for _, host := range result.Hosts {
+		fmt.Println("Host:", host)
+	}
+	for _, host := range result.UnmappedHosts {
+		fmt.Printf("Host %s is not on the %s domain, add it to the %s ingress by hand\n", host, from, to)
+	}
+	if len(result.Secrets) > 0 {
+		fmt.Printf("Secrets to re-create for %s:\n", to)
+		for _, s := range result.Secrets {
+			command := fmt.Sprintf("fleet secret:create --app %s --env %s --file <env-file>", appName, to)
+			if s.SecretName() != secret.DefaultSecretName(appName, from) {
+				command += " --name " + s.SecretName()
+			}
+			fmt.Printf("  %s (%s): %s\n", s.SecretName(), strings.Join(s.Keys(), ", "), command)
+		}
+	}
+	for _, name := range result.UndefinedSecrets {
+		fmt.Printf("Secret %s is referenced by %s but not defined in its overlay, it has to exist in the %s namespace\n", name, appName, to)
+	}
+	fmt.Printf("App successfully promoted from %s to %s: %s\n", from, to, appName)
+}
+
 func genSecret(cmd *cobra.Command, args []string) {
 	env, _ := cmd.Flags().GetString("env")
 	envFile, _ := cmd.Flags().GetString("file")
 	appName, _ := cmd.Flags().GetString("app")
+	secretName, _ := cmd.Flags().GetString("name")
+	containers, _ := cmd.Flags().GetStringSlice("container")
+	if secretName == "" {
+		secretName = secret.DefaultSecretName(appName, env)
+	}
+	if err := secret.ValidateSecretName(secretName); err != nil {
+		fmt.Println("Error creating secret:", err)
+		os.Exit(1)
+	}
 	fleet_app_path := filepath.Join(config.AppTemplatePath, env, appName)
 	envMap, err := common.ParseEnvFile(envFile, false)
 	if err != nil {
 		fmt.Println("Error reading .env file:", err)
 		os.Exit(1)
 	}
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error reading fleet config:", err)
+		os.Exit(1)
+	}
+	environment := fleetConfig.Environment(env)
+	backend, err := secret.NewBackend(environment)
+	if err != nil {
+		fmt.Println("Error selecting secret backend:", err)
+		os.Exit(1)
+	}
+	// The cluster must be able to decrypt the secret before it is committed
+	err = backend.Configure(environment)
+	if err != nil {
+		fmt.Printf("Error configuring the %s backend for %s: %v\n", backend.Name(), env, err)
+		os.Exit(1)
+	}
 
 	// Create Kubernetes Secret YAML
-	secretYaml := secret.CreateSecretYaml(appName, env, envMap)
+	secretYaml := secret.CreateSecretYaml(secretName, env, envMap)
 	secretFileName := fmt.Sprintf("%s.%s.secret.yaml", appName, env)
 	err = ioutil.WriteFile(secretFileName, []byte(secretYaml), 0644)
 	if err != nil {
@@ -143,12 +1085,11 @@ func genSecret(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	// Seal the secret using kubeseal
-	// sealedSecretFileName := fmt.Sprintf("sealed.%s.%s.secret.yaml", appName, env)
-	sealedSecretFileName := "sealed-secret.yaml"
-	err = secret.SealSecret(fleet_app_path, secretFileName, sealedSecretFileName)
+	// Encrypt the secret with the environment's backend
+	sealedSecretFileName := secret.SecretPath(secretName, backend)
+	err = backend.Encrypt(secretFileName, filepath.Join(fleet_app_path, sealedSecretFileName))
 	if err != nil {
-		fmt.Println("Error sealing secret:", err)
+		fmt.Println("Error encrypting secret:", err)
 		os.Exit(1)
 	}
 	// Update the kustomization.yaml file
@@ -159,9 +1100,12 @@ func genSecret(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 	// Update the deployment.yaml file with secret keys
-	deploymentFile := filepath.Join(fleet_app_path, "deployment.yaml")
-	//    sealedSecretFile := filepath.Join(fleet_app_path, "secrets", sealedSecretFileName)
-	err = secret.AddSecretKeysToDeployment(secretFileName, deploymentFile, envFile)
+	deploymentFile, err := application.FindWorkloadFile(fleet_app_path)
+	if err != nil {
+		fmt.Println("Error updating deployment.yaml:", err)
+		os.Exit(1)
+	}
+	err = secret.AddSecretKeysToDeployment(secretName, deploymentFile, envFile, containers)
 	if err != nil {
 		fmt.Println("Error updating deployment.yaml:", err)
 		os.Exit(1)
@@ -175,7 +1119,99 @@ func genSecret(cmd *cobra.Command, args []string) {
 		fmt.Printf("Error deleting file: %s", secretFileName)
 	}
 
-	fmt.Println("Secret successfully created and sealed:", sealedSecretFileName)
+	fmt.Printf("Secret successfully created and encrypted with %s: %s\n", backend.Name(), filepath.Join(fleet_app_path, sealedSecretFileName))
+}
+
+func secretStatus(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	appName, _ := cmd.Flags().GetString("app")
+	envFile, _ := cmd.Flags().GetString("file")
+	secretName, _ := cmd.Flags().GetString("name")
+	fleet_app_path := filepath.Join(config.AppTemplatePath, env, appName)
+
+	status, err := secret.CheckStatus(fleet_app_path, envFile, secretName)
+	if err != nil {
+		fmt.Println("Error checking secret status:", err)
+		os.Exit(1)
+	}
+	for _, s := range status.Secrets {
+		fmt.Printf("Encrypted secret %s (%d keys): %s\n", s.SecretName(), len(s.Spec.EncryptedData), s.File)
+	}
+	printKeys := func(title string, keys []string) {
+		fmt.Printf("%s: %d\n", title, len(keys))
+		for _, key := range keys {
+			fmt.Println("  -", key)
+		}
+	}
+	printKeys("Missing (referenced by deployment, not sealed)", status.Missing)
+	printKeys("Orphaned (sealed, not referenced by deployment)", status.Orphaned)
+	if envFile != "" {
+		printKeys("Extra (in .env, not sealed)", status.Extra)
+	}
+	if status.HasDrift() {
+		fmt.Println("Secret drift detected for", appName)
+		os.Exit(1)
+	}
+	fmt.Println("Secrets in sync for", appName)
+}
+
+func resealSecrets(cmd *cobra.Command, args []string) {
+	certFile, _ := cmd.Flags().GetString("cert")
+	env, _ := cmd.Flags().GetString("env")
+	plaintextDir, _ := cmd.Flags().GetString("plaintext")
+	root := filepath.Join(config.AppTemplatePath, env)
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error reading fleet config:", err)
+		os.Exit(1)
+	}
+
+	results, err := secret.Reseal(root, certFile, plaintextDir, fleetConfig)
+	if err != nil {
+		fmt.Println("Error resealing secrets:", err)
+		os.Exit(1)
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("%s: %s failed: %v\n", result.File, result.Name, result.Err)
+			continue
+		}
+		fmt.Printf("%s: %s resealed (%s)", result.File, result.Name, result.Method)
+		if len(result.Added) > 0 {
+			fmt.Printf(", added %s", strings.Join(result.Added, ","))
+		}
+		if len(result.Removed) > 0 {
+			fmt.Printf(", removed %s", strings.Join(result.Removed, ","))
+		}
+		fmt.Println()
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d sealed secrets could not be resealed\n", failed, len(results))
+		os.Exit(1)
+	}
+	fmt.Printf("%d sealed secrets resealed\n", len(results))
+}
+
+func fetchCert(cmd *cobra.Command, args []string) {
+	env, _ := cmd.Flags().GetString("env")
+	fleetConfig, err := config.LoadFleetConfig()
+	if err != nil {
+		fmt.Println("Error reading fleet config:", err)
+		os.Exit(1)
+	}
+	environment := fleetConfig.Environment(env)
+	err = secret.FetchCertificate(environment)
+	if err != nil {
+		fmt.Println("Error fetching certificate:", err)
+		os.Exit(1)
+	}
+	warning, _ := secret.ValidateCertificate(environment.SealingCert)
+	if warning != "" {
+		fmt.Println("Warning:", warning)
+	}
+	fmt.Println("Certificate successfully stored:", environment.SealingCert)
 }
 
 func newSetup(cmd *cobra.Command, args []string) {
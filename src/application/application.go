@@ -1,28 +1,203 @@
 package application
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"text/template"
 
 	"github.com/africhild/fleet-infra/src/common"
 	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
 	"github.com/africhild/fleet-infra/src/storage"
 	"github.com/sirupsen/logrus"
 )
 
+// App kinds
+const (
+	KindWeb         = "web"
+	KindWorker      = "worker"
+	KindCronJob     = "cronjob"
+	KindStatefulSet = "statefulset"
+)
+
+// Kinds lists the supported app kinds
+var Kinds = []string{KindWeb, KindWorker, KindCronJob, KindStatefulSet}
+
 // App represents an application configuration
 type App struct {
-	Name      string
-	Namespace string // out
-	Env       string // out
-	Port      int
-	ImageHost string // ghcr.io or docker.io
-	Image     string
-	Templates []Template
-	Replicas  int
+	Name        string
+	Kind        string
+	Namespace   string // out
+	Env         string // out
+	Port        int
+	ImageHost   string // ghcr.io or docker.io
+	Image       string
+	Tag         string
+	Templates   []Template
+	Replicas    int
+	Schedule    string // cronjob only
+	StorageSize string // statefulset only
+	BasePath    string // base directory relative to the overlay, set by Create
+
+	Containers       []Container // sidecars and init containers
+	Autoscale        Autoscale
+	DisruptionBudget bool // render a PodDisruptionBudget
+
+	// ImageAutomation generates the Flux image resources and setter markers
+	ImageAutomation bool
+	ImagePolicy     string // timestamp or semver:<range>
+	GitBranch       string // branch the image automation commits to
+
+	// NamespaceSettings are the labels, quota and limit range of the
+	// environment namespace, rendered by the Common templates
+	NamespaceSettings config.NamespaceSettings
+	// Ingress renders the environment ingress, which only exists once it has
+	// a rule, see EnsureIngress
+	Ingress bool
+
+	ReadinessPath   string
+	LivenessPath    string
+	Resources       Resources
+	SecurityContext SecurityContext
+
+	// EnvReadinessPath and EnvLivenessPath are probe paths from the
+	// environment defaults. The base is shared, so the overlay patches them in.
+	EnvReadinessPath string
+	EnvLivenessPath  string
+}
+
+var (
+	cronFieldPattern = regexp.MustCompile(`^[0-9*/,\-A-Za-z?]+$`)
+	tagPattern       = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	quantityPattern  = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(Ki|Mi|Gi|Ti|Pi|Ei|k|M|G|T|P|E)?$`)
+)
+
+// Workload returns the name of the workload resource generated for the app kind
+func (a *App) Workload() string {
+	switch a.Kind {
+	case KindCronJob:
+		return "cronjob"
+	case KindStatefulSet:
+		return "statefulset"
+	default:
+		return "deployment"
+	}
+}
+
+// WorkloadKind returns the kubernetes kind of the workload resource
+func (a *App) WorkloadKind() string {
+	switch a.Kind {
+	case KindCronJob:
+		return "CronJob"
+	case KindStatefulSet:
+		return "StatefulSet"
+	default:
+		return "Deployment"
+	}
+}
+
+// ExposesPort reports whether the app kind serves traffic through a Service
+func (a *App) ExposesPort() bool {
+	return a.Kind == KindWeb || a.Kind == KindStatefulSet
+}
+
+// ImageRepository returns the image without its tag or digest
+func (a *App) ImageRepository() string {
+	repository, _ := splitImage(a.Image)
+	return repository
+}
+
+// SemverRange returns the range of a semver image policy, "" for the others
+func (a *App) SemverRange() string {
+	if !strings.HasPrefix(a.ImagePolicy, "semver:") {
+		return ""
+	}
+	return strings.TrimPrefix(a.ImagePolicy, "semver:")
+}
+
+// FindWorkloadFile returns the workload manifest of an app overlay or base directory
+func FindWorkloadFile(appDir string) (string, error) {
+	for _, name := range []string{"deployment", "statefulset", "cronjob"} {
+		file := filepath.Join(appDir, name+".yaml")
+		exists, err := common.CheckFileExists(file)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("no workload manifest found in %s", appDir)
+}
+
+// Validate checks the kind specific settings of the app
+func (a *App) Validate() error {
+	if a.Kind == "" {
+		a.Kind = KindWeb
+	}
+	known := false
+	for _, kind := range Kinds {
+		if a.Kind == kind {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("invalid kind %s, use one of %s", a.Kind, strings.Join(Kinds, "|"))
+	}
+	if a.Name == "common" {
+		return fmt.Errorf("common is reserved for the environment's shared resources")
+	}
+	if a.ExposesPort() && (a.Port <= 0 || a.Port > 65535) {
+		return fmt.Errorf("invalid port %d", a.Port)
+	}
+	if a.Kind == KindCronJob {
+		fields := strings.Fields(a.Schedule)
+		if len(fields) != 5 && !strings.HasPrefix(a.Schedule, "@") {
+			return fmt.Errorf("cronjob needs a --schedule with 5 fields, got %q", a.Schedule)
+		}
+		for _, field := range fields {
+			if !cronFieldPattern.MatchString(field) {
+				return fmt.Errorf("invalid schedule field %q", field)
+			}
+		}
+	}
+	if a.Kind == KindCronJob && (a.Autoscale.IsSet() || a.DisruptionBudget) {
+		return fmt.Errorf("cronjob apps cannot be autoscaled or have a disruption budget")
+	}
+	if err := a.validateContainers(); err != nil {
+		return err
+	}
+	if err := a.Autoscale.Validate(); err != nil {
+		return err
+	}
+	if a.Autoscale.IsSet() && a.Resources.Requests.CPU == "" {
+		return fmt.Errorf("autoscaling on cpu utilization needs a cpu request")
+	}
+	if a.Tag != "" && !tagPattern.MatchString(a.Tag) {
+		return fmt.Errorf("invalid image tag %q", a.Tag)
+	}
+	if a.ImageAutomation {
+		if a.ImagePolicy == "" {
+			a.ImagePolicy = "timestamp"
+		}
+		if a.ImagePolicy != "timestamp" && (!strings.HasPrefix(a.ImagePolicy, "semver:") || a.SemverRange() == "") {
+			return fmt.Errorf("invalid image policy %q, use timestamp or semver:<range>", a.ImagePolicy)
+		}
+	}
+	if a.Kind == KindStatefulSet && !quantityPattern.MatchString(a.StorageSize) {
+		return fmt.Errorf("invalid storage size %q", a.StorageSize)
+	}
+	if !a.ExposesPort() && (a.ReadinessPath != "" || a.LivenessPath != "") {
+		return fmt.Errorf("%s apps have no port to probe", a.Kind)
+	}
+	return a.Resources.Validate()
 }
 
 var (
@@ -37,25 +212,56 @@ func init() {
 	log.SetLevel(logrus.InfoLevel)
 }
 
-// Create creates a new application directory
+// Create creates a new application directory, the files and port it created
+// are removed again when a step fails
 func (a *App) Create(appPath string) error {
+	undo := &rollback{}
+	if err := a.create(appPath, undo); err != nil {
+		undo.restore()
+		return err
+	}
+	return nil
+}
+
+func (a *App) create(appPath string, undo *rollback) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
 	log.WithFields(logrus.Fields{
 		"appPath": appPath,
 		"appName": a.Name,
+		"kind":    a.Kind,
 		"env":     a.Env,
 		"port":    a.Port,
 		"replica": a.Replicas,
 	}).Info("Creating new application")
+	if filepath.Join(appPath) == filepath.Join(basePath) {
+		return fmt.Errorf("%s is reserved for bases and cannot be used as an environment", a.Env)
+	}
 	_basePath := filepath.Join(basePath, a.Name)
-	if err := common.EnsureDirectoryExists(_basePath); err != nil {
+	// The port is only claimed when the base is created, other environments
+	// reuse it
+	baseExists, err := common.CheckFileExists(_basePath)
+	if err != nil {
+		return fmt.Errorf("error checking base path: %w", err)
+	}
+	if !baseExists && a.ExposesPort() && storage.IsPortUsed(a.Port) {
+		return fmt.Errorf("port %d is already in use", a.Port)
+	}
+	if err := undo.mkdir(_basePath); err != nil {
 		return fmt.Errorf("failed to create base path: %w", err)
 	}
 	_appPath := filepath.Join(appPath, a.Name)
-	if err := common.EnsureDirectoryExists(_appPath); err != nil {
+	if err := undo.mkdir(_appPath); err != nil {
 		return fmt.Errorf("failed to create app path: %w", err)
 	}
+	relBase, err := filepath.Rel(_appPath, _basePath)
+	if err != nil {
+		return fmt.Errorf("failed to locate base from %s: %w", _appPath, err)
+	}
+	a.BasePath = filepath.ToSlash(relBase)
 	_commonPath := filepath.Join(appPath, "common")
-	if err := common.EnsureDirectoryExists(_commonPath); err != nil {
+	if err := undo.mkdir(_commonPath); err != nil {
 		return fmt.Errorf("failed to create common path: %w", err)
 	}
 
@@ -67,7 +273,39 @@ func (a *App) Create(appPath string) error {
 	//	return fmt.Errorf("failed to create application directory: %w", err)
 	//}
 
-	return a.createYAML(appPath)
+	for _, tmpl := range a.Templates {
+		path, err := a.filePath(tmpl, appPath)
+		if err != nil {
+			return err
+		}
+		if err := undo.track(path); err != nil {
+			return err
+		}
+	}
+	if err := a.createYAML(appPath); err != nil {
+		return err
+	}
+	if a.ImageAutomation {
+		// the environment's common directory may predate image automation
+		commonKustomization := filepath.Join(_commonPath, "kustomization.yaml")
+		if err := undo.track(commonKustomization); err != nil {
+			return err
+		}
+		if _, err := manifest.AddResource(commonKustomization, "image-update-automation.yaml"); err != nil {
+			return fmt.Errorf("error adding image automation to %s: %w", commonKustomization, err)
+		}
+	}
+
+	// make sure what was generated renders before the port is claimed
+	if _, err := render.Build(_appPath); err != nil {
+		return fmt.Errorf("generated overlay %s does not render: %w", _appPath, err)
+	}
+	if !baseExists && a.ExposesPort() {
+		if err := storage.AddPort(a.Name, a.Port); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (a *App) createYAML(appPath string) error {
@@ -75,6 +313,13 @@ func (a *App) createYAML(appPath string) error {
 	errCh := make(chan error, len(a.Templates))
 
 	for _, tmpl := range a.Templates {
+		enabled, err := tmpl.Enabled(a)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			continue
+		}
 		wg.Add(1)
 		go func(tmpl Template) {
 			defer wg.Done()
@@ -97,17 +342,29 @@ func (a *App) createYAML(appPath string) error {
 	return nil
 }
 
-func (a *App) createFile(tmpl Template, appPath string) error {
-	var tempFile string
+// filePath returns the file a template renders to
+func (a *App) filePath(tmpl Template, appPath string) (string, error) {
+	var root string
 	switch tmpl.Type {
-	case "Base":
-		tempFile = common.GetPath(filepath.Join(basePath, a.Name), tmpl.Name)
-	case "Common":
-		tempFile = common.GetPath(appPath, tmpl.Name)
-	case "Application":
-		tempFile = common.GetPath(filepath.Join(appPath, a.Name), tmpl.Name)
+	case Base.String():
+		root = filepath.Join(basePath, a.Name)
+	case Common.String():
+		root = appPath
+	case Application.String():
+		root = filepath.Join(appPath, a.Name)
 	default:
-		return fmt.Errorf("invalid template type: %s", tmpl.Type)
+		return "", fmt.Errorf("invalid template type: %s", tmpl.Type)
+	}
+	if tmpl.Path != "" {
+		return filepath.Join(root, tmpl.Path), nil
+	}
+	return common.GetPath(root, tmpl.Name), nil
+}
+
+func (a *App) createFile(tmpl Template, appPath string) error {
+	tempFile, err := a.filePath(tmpl, appPath)
+	if err != nil {
+		return err
 	}
 
 	fileExist, err := common.CheckFileExists(tempFile)
@@ -115,35 +372,35 @@ func (a *App) createFile(tmpl Template, appPath string) error {
 		return fmt.Errorf("error checking file %s: %w", tempFile, err)
 	}
 	if !fileExist {
-		// remove lines with # or // from the tmpl.content
-		// Check if the port is in use
-		if tmpl.Type == "Base" && (tmpl.Name == "deployment" || tmpl.Name == "service") {
-			if storage.IsPortUsed(a.Port) {
-				return fmt.Errorf("port %d is already in use", a.Port)
-			}
-		}
-		err := common.RemoveComments(&tmpl.Content)
+		content, err := a.renderTemplate(tmpl)
 		if err != nil {
-			return fmt.Errorf("error removing comments from template %s: %w", tmpl.Name, err)
+			return err
 		}
-		newTmpl, err := template.New(tmpl.Name).Parse(tmpl.Content)
-		if err != nil {
-			return fmt.Errorf("error parsing template %s: %w", tmpl.Name, err)
+		if err := common.EnsureDirectoryExists(filepath.Dir(tempFile)); err != nil {
+			return fmt.Errorf("error creating directory for %s: %w", tempFile, err)
 		}
-
-		file, err := os.Create(tempFile)
-		if err != nil {
+		if err := os.WriteFile(tempFile, content, 0644); err != nil {
 			return fmt.Errorf("error creating file %s: %w", tempFile, err)
 		}
-		defer file.Close()
-
-		if err := newTmpl.Execute(file, a); err != nil {
-			return fmt.Errorf("error executing template %s: %w", tmpl.Name, err)
-		}
-		if tmpl.Type == "Base" && (tmpl.Name == "deployment" || tmpl.Name == "service") {
-			storage.AddPort(a.Name, a.Port)
-		}
 		log.WithField("file", tempFile).Info("File created successfully")
 	}
 	return nil
 }
+
+// renderTemplate executes a template for the app
+func (a *App) renderTemplate(tmpl Template) ([]byte, error) {
+	// remove lines with # or // from the tmpl.content
+	err := common.RemoveComments(&tmpl.Content)
+	if err != nil {
+		return nil, fmt.Errorf("error removing comments from template %s: %w", tmpl.Name, err)
+	}
+	newTmpl, err := template.New(tmpl.Name).Funcs(templateFuncs).Parse(tmpl.Content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template %s: %w", tmpl.Name, err)
+	}
+	var content bytes.Buffer
+	if err := newTmpl.Execute(&content, a); err != nil {
+		return nil, fmt.Errorf("error executing template %s: %w", tmpl.Name, err)
+	}
+	return content.Bytes(), nil
+}
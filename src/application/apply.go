@@ -0,0 +1,301 @@
+package application
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/ingress"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
+	"github.com/africhild/fleet-infra/src/secret"
+	"github.com/africhild/fleet-infra/src/storage"
+)
+
+// ApplyResult lists what Apply changed and what it left to the user
+type ApplyResult struct {
+	Changes []Change
+	// Notes are actions Apply cannot take itself, like creating a secret
+	Notes []string
+}
+
+// Apply reconciles the base, the overlays, the ingress rules and the port
+// registry with the spec. Missing apps are created, existing ones updated in
+// place. Settings the spec leaves out are not touched. When an environment
+// fails, the changes to every environment are undone.
+func Apply(spec *Spec, templates []Template, fleetConfig *config.FleetConfig) (*ApplyResult, error) {
+	undo := &rollback{}
+	if err := undo.snapshot(config.AppTemplatePath); err != nil {
+		return nil, err
+	}
+	if err := undo.track(storage.PortFile); err != nil {
+		return nil, err
+	}
+	result := &ApplyResult{}
+	for _, env := range spec.EnvironmentNames() {
+		if err := applyEnvironment(spec, env, templates, fleetConfig.Environment(env), result); err != nil {
+			undo.restore()
+			return nil, fmt.Errorf("%s: %w", env, err)
+		}
+	}
+	return result, nil
+}
+
+// App returns the app the spec describes in env
+func (s *Spec) App(env string, templates []Template, environment config.Environment) (*App, error) {
+	envSpec := s.Environments[env]
+	repository := s.Image
+	if repository == "" {
+		repository = fmt.Sprintf("%s/%s", config.ImageHost, s.Name)
+	}
+	tag := envSpec.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	app := &App{
+		Name:          s.Name,
+		Kind:          s.Kind,
+		Namespace:     env,
+		Env:           env,
+		Port:          s.Port,
+		ImageHost:     config.ImageHost,
+		Image:         fmt.Sprintf("%s:%s", repository, tag),
+		Tag:           tag,
+		Replicas:      1,
+		Templates:     templates,
+		Schedule:      s.Schedule,
+		StorageSize:   s.StorageSize,
+		ReadinessPath: s.ReadinessPath,
+		LivenessPath:  s.LivenessPath,
+		Resources:     s.Resources,
+		GitBranch:     environment.GitBranch,
+	}
+	app.NamespaceSettings = environment.Namespace
+	if app.StorageSize == "" {
+		app.StorageSize = "1Gi"
+	}
+	if envSpec.Replicas != nil {
+		app.Replicas = *envSpec.Replicas
+	}
+	if envSpec.Autoscale != "" {
+		autoscale, err := ParseAutoscale(envSpec.Autoscale)
+		if err != nil {
+			return nil, err
+		}
+		app.Autoscale = autoscale
+	}
+	if override := envSpec.Resources; override != nil {
+		overrideQuantity(&app.Resources.Requests.CPU, override.Requests.CPU)
+		overrideQuantity(&app.Resources.Requests.Memory, override.Requests.Memory)
+		overrideQuantity(&app.Resources.Limits.CPU, override.Limits.CPU)
+		overrideQuantity(&app.Resources.Limits.Memory, override.Limits.Memory)
+	}
+	app.ApplyDefaults(environment.AppDefaults)
+	return app, app.Validate()
+}
+
+func overrideQuantity(value *string, override string) {
+	if override != "" {
+		*value = override
+	}
+}
+
+func applyEnvironment(spec *Spec, env string, templates []Template, environment config.Environment, result *ApplyResult) error {
+	envSpec := spec.Environments[env]
+	app, err := spec.App(env, templates, environment)
+	if err != nil {
+		return err
+	}
+	overlayPath := filepath.Join(config.AppTemplatePath, env, app.Name)
+	exists, err := common.CheckFileExists(overlayPath)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if err := app.Create(filepath.Join(config.AppTemplatePath, env)); err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, Change{File: overlayPath, Field: "app", New: "created"})
+	} else {
+		workloadFile, err := FindWorkloadFile(overlayPath)
+		if err != nil {
+			return err
+		}
+		file, err := manifest.Load(workloadFile)
+		if err != nil {
+			return err
+		}
+		workload := file.FindWorkload()
+		if workload == nil {
+			return fmt.Errorf("no workload found in %s", workloadFile)
+		}
+		if manifest.Kind(workload) != app.WorkloadKind() {
+			return fmt.Errorf("%s is a %s, the kind of an existing app cannot change", app.Name, manifest.Kind(workload))
+		}
+		if spec.StorageSize != "" && app.Kind == KindStatefulSet {
+			if err := checkStorageSize(app.Name, spec.StorageSize); err != nil {
+				return err
+			}
+		}
+
+		// a replica count in the spec replaces an autoscaler it no longer lists
+		opts := UpdateOptions{Replicas: envSpec.Replicas, App: app, RemoveAutoscale: !app.Autoscale.IsSet()}
+		if envSpec.Tag != "" {
+			opts.Image = &app.Image
+		} else if spec.Image != "" {
+			// without a tag the tag belongs to ci or image automation, only
+			// the repository follows the spec
+			container, err := mainContainer(workload, app.Name)
+			if err != nil {
+				return err
+			}
+			_, reference := splitImage(manifest.Scalar(container, "image"))
+			image := spec.Image + reference
+			opts.Image = &image
+		}
+		if spec.Schedule != "" {
+			opts.Schedule = &spec.Schedule
+		}
+		if spec.ReadinessPath != "" {
+			opts.ReadinessPath = &spec.ReadinessPath
+		}
+		if spec.LivenessPath != "" {
+			opts.LivenessPath = &spec.LivenessPath
+		}
+		if spec.Port != 0 && app.ExposesPort() {
+			opts.Port = &app.Port
+		}
+		if app.Resources.IsSet() {
+			opts.Resources = &app.Resources
+		}
+		if app.Autoscale.IsSet() {
+			opts.Autoscale = &app.Autoscale
+		}
+		changes, err := Update(env, app.Name, opts)
+		if err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, changes...)
+	}
+
+	if envSpec.Hosts != nil && app.ExposesPort() {
+		changes, err := applyHosts(env, app.Name, envSpec.Hosts, environment, templates)
+		if err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, changes...)
+	}
+
+	if len(envSpec.Secrets) > 0 {
+		notes, err := checkSecrets(env, app.Name, overlayPath, envSpec.Secrets)
+		if err != nil {
+			return err
+		}
+		result.Notes = append(result.Notes, notes...)
+	}
+
+	if _, err := render.Build(overlayPath); err != nil {
+		return fmt.Errorf("overlay %s does not render: %w", overlayPath, err)
+	}
+	return nil
+}
+
+// checkStorageSize refuses a storage size the base statefulset does not have,
+// the volumeClaimTemplates of a statefulset cannot change
+func checkStorageSize(name, size string) error {
+	workloadFile, err := FindWorkloadFile(filepath.Join(basePath, name))
+	if err != nil {
+		return err
+	}
+	file, err := manifest.Load(workloadFile)
+	if err != nil {
+		return err
+	}
+	workload := file.FindWorkload()
+	claims := manifest.Get(workload, "spec", "volumeClaimTemplates")
+	if claims == nil {
+		return nil
+	}
+	for _, claim := range claims.Content {
+		current := manifest.Scalar(claim, "spec", "resources", "requests", "storage")
+		if current != "" && current != size {
+			return fmt.Errorf("storage of %s is %s in %s, the volumeClaimTemplates of a statefulset cannot change, resize the claims by hand", name, current, workloadFile)
+		}
+	}
+	return nil
+}
+
+// applyHosts makes the ingress rules of the app match the wanted subdomains
+func applyHosts(env, name string, subdomains []string, environment config.Environment, templates []Template) ([]Change, error) {
+	ingressFile := filepath.Join(config.AppTemplatePath, env, "common", "ingress.yaml")
+	current, err := ingress.Hosts(env, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(subdomains) > 0 {
+		if err := EnsureIngress(templates, env); err != nil {
+			return nil, err
+		}
+	}
+	wanted := make(map[string]bool, len(subdomains))
+	var changes []Change
+	for _, subdomain := range subdomains {
+		host := environment.Host(subdomain)
+		wanted[host] = true
+		added, err := ingress.AddRule(env, host, name, 80)
+		if err != nil {
+			return nil, err
+		}
+		if added {
+			changes = append(changes, Change{File: ingressFile, Field: "rules", New: host})
+		}
+	}
+	for _, host := range current {
+		if wanted[host] {
+			continue
+		}
+		removed, err := ingress.RemoveRule(env, host)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			changes = append(changes, Change{File: ingressFile, Field: "rules", Old: host, New: "<removed>"})
+		}
+	}
+	return changes, nil
+}
+
+// checkSecrets reports the secrets and keys of the spec missing from the overlay
+func checkSecrets(env, name, overlayPath string, secrets []SecretSpec) ([]string, error) {
+	status, err := secret.CheckStatus(overlayPath, "", "")
+	if err != nil {
+		return nil, err
+	}
+	var notes []string
+	for _, wanted := range secrets {
+		var found *secret.SealedSecret
+		for i := range status.Secrets {
+			if status.Secrets[i].SecretName() == wanted.Name {
+				found = &status.Secrets[i]
+				break
+			}
+		}
+		if found == nil {
+			notes = append(notes, fmt.Sprintf("secret %s is missing in %s, run fleet secret:create --app %s --env %s --name %s --file <env-file>", wanted.Name, env, name, env, wanted.Name))
+			continue
+		}
+		var missing []string
+		for _, key := range wanted.Keys {
+			if _, ok := found.Spec.EncryptedData[key]; !ok {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > 0 {
+			notes = append(notes, fmt.Sprintf("secret %s in %s is missing keys %s", wanted.Name, env, strings.Join(missing, ", ")))
+		}
+	}
+	return notes, nil
+}
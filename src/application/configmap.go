@@ -0,0 +1,355 @@
+package application
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
+	"gopkg.in/yaml.v3"
+)
+
+// configDir holds the generator sources, relative to the app overlay
+const configDir = "config"
+
+// invalidKeyChars are the characters a config map key cannot hold
+var invalidKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]+`)
+
+// ConfigOptions describes the configuration handed to config:set
+type ConfigOptions struct {
+	// EnvFile is a KEY=value file injected into the containers with envFrom
+	EnvFile string
+	// Files are mounted as a volume at MountPath, one file per key
+	Files     []string
+	MountPath string
+	// Name of the generated config maps, default <app>-config
+	Name       string
+	Containers []string
+}
+
+// SetConfig copies the configuration into the app overlay, generates config
+// maps for it with kustomize and wires them into the workload. Kustomize appends
+// a content hash to the generated names, so pods restart when the config changes.
+// Nothing is changed when the overlay does not render afterwards.
+func SetConfig(env, name string, opts ConfigOptions) ([]Change, error) {
+	undo := &rollback{}
+	changes, err := setConfig(env, name, opts, undo)
+	if err != nil {
+		undo.restore()
+		return nil, err
+	}
+	return changes, nil
+}
+
+func setConfig(env, name string, opts ConfigOptions, undo *rollback) ([]Change, error) {
+	if opts.EnvFile == "" && len(opts.Files) == 0 {
+		return nil, fmt.Errorf("no env file or files to mount")
+	}
+	overlayPath := filepath.Join(config.AppTemplatePath, env, name)
+	exists, err := common.CheckFileExists(overlayPath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("app %s does not exist in %s, use app:create", name, env)
+	}
+	if opts.Name == "" {
+		opts.Name = name + "-config"
+	}
+	if opts.MountPath == "" {
+		opts.MountPath = path.Join("/etc", name)
+	}
+
+	var changes []Change
+	generators := make(map[string]map[string][]string)
+	if opts.EnvFile != "" {
+		if _, err := common.ParseEnvFile(opts.EnvFile, true); err != nil {
+			return nil, err
+		}
+		rel := path.Join(configDir, opts.Name+".env")
+		changed, err := copyConfigFile(opts.EnvFile, filepath.Join(overlayPath, rel), undo)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			changes = append(changes, Change{File: filepath.Join(overlayPath, rel), Field: "content", New: opts.EnvFile})
+		}
+		generators[opts.Name] = map[string][]string{"envs": {rel}}
+	}
+	filesName := opts.Name + "-files"
+	if len(opts.Files) > 0 {
+		var sources []string
+		keys := configKeys(opts.Files)
+		for i, file := range opts.Files {
+			rel := path.Join(configDir, filesName, keys[i])
+			changed, err := copyConfigFile(file, filepath.Join(overlayPath, rel), undo)
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				changes = append(changes, Change{File: filepath.Join(overlayPath, rel), Field: "content", New: file})
+			}
+			sources = append(sources, rel)
+		}
+		generators[filesName] = map[string][]string{"files": sources}
+	}
+
+	kustomizationFile := filepath.Join(overlayPath, "kustomization.yaml")
+	if err := undo.track(kustomizationFile); err != nil {
+		return nil, err
+	}
+	kustomizationChanges, err := setConfigMapGenerators(kustomizationFile, generators)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, kustomizationChanges...)
+
+	workloadFile, err := FindWorkloadFile(overlayPath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := manifest.Load(workloadFile)
+	if err != nil {
+		return nil, err
+	}
+	workload := file.FindWorkload()
+	if workload == nil {
+		return nil, fmt.Errorf("no workload found in %s", workloadFile)
+	}
+	containers := opts.Containers
+	if len(containers) == 0 {
+		container, err := mainContainer(workload, name)
+		if err != nil {
+			return nil, err
+		}
+		containers = []string{manifest.Scalar(container, "name")}
+	}
+	workloadChanged := false
+	for _, containerName := range containers {
+		container, err := manifest.Container(workload, containerName)
+		if err != nil {
+			return nil, err
+		}
+		if opts.EnvFile != "" {
+			var source configMapEnvSource
+			source.ConfigMapRef.Name = opts.Name
+			added, err := addListItem(container, "envFrom", "configMapRef", opts.Name, source)
+			if err != nil {
+				return nil, err
+			}
+			if added {
+				changes = append(changes, Change{File: workloadFile, Field: fmt.Sprintf("containers[%s].envFrom", containerName), New: opts.Name})
+				workloadChanged = true
+			}
+		}
+		if len(opts.Files) > 0 {
+			mount := volumeMount{Name: filesName, MountPath: opts.MountPath, ReadOnly: true}
+			mounted, err := setVolumeMount(container, mount)
+			if err != nil {
+				return nil, err
+			}
+			if mounted {
+				changes = append(changes, Change{File: workloadFile, Field: fmt.Sprintf("containers[%s].volumeMounts[%s]", containerName, filesName), New: opts.MountPath})
+				workloadChanged = true
+			}
+		}
+	}
+	if len(opts.Files) > 0 {
+		volume := configMapVolume{Name: filesName}
+		volume.ConfigMap.Name = filesName
+		added, err := addListItem(manifest.PodSpec(workload), "volumes", "name", filesName, volume)
+		if err != nil {
+			return nil, err
+		}
+		if added {
+			changes = append(changes, Change{File: workloadFile, Field: fmt.Sprintf("volumes[%s]", filesName), New: "configMap " + filesName})
+			workloadChanged = true
+		}
+	}
+	if workloadChanged {
+		if err := undo.track(workloadFile); err != nil {
+			return nil, err
+		}
+		if err := file.Save(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := render.Build(overlayPath); err != nil {
+		return nil, fmt.Errorf("overlay %s does not render: %w", overlayPath, err)
+	}
+	return changes, nil
+}
+
+// copyConfigFile copies src to dst, reporting whether dst changed
+func copyConfigFile(src, dst string, undo *rollback) (bool, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return false, err
+	}
+	if current, err := os.ReadFile(dst); err == nil && string(current) == string(data) {
+		return false, nil
+	}
+	if err := undo.mkdir(filepath.Dir(dst)); err != nil {
+		return false, err
+	}
+	if err := undo.track(dst); err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(dst, data, 0644)
+}
+
+// configKeys returns the config map key of each file, its base name unless
+// another file has the same one. Those are prefixed with their directory and
+// numbered when that is not enough.
+func configKeys(files []string) []string {
+	count := make(map[string]int, len(files))
+	for _, file := range files {
+		count[filepath.Base(file)]++
+	}
+	keys := make([]string, len(files))
+	used := make(map[string]bool, len(files))
+	for i, file := range files {
+		key := filepath.Base(file)
+		if count[key] > 1 {
+			dir := filepath.Base(filepath.Dir(file))
+			key = invalidKeyChars.ReplaceAllString(dir, "-") + "-" + key
+		}
+		for n := 2; used[key]; n++ {
+			key = fmt.Sprintf("%d-%s", n, filepath.Base(file))
+		}
+		used[key] = true
+		keys[i] = key
+	}
+	return keys
+}
+
+// setConfigMapGenerators replaces the sources of the named configMapGenerator
+// entries of a kustomization, adding the entries that are missing
+func setConfigMapGenerators(kustomizationFile string, generators map[string]map[string][]string) ([]Change, error) {
+	file, err := manifest.Load(kustomizationFile)
+	if err != nil {
+		return nil, err
+	}
+	doc := file.Find("Kustomization")
+	if doc == nil {
+		return nil, fmt.Errorf("no kustomization found in %s", kustomizationFile)
+	}
+	list := manifest.Get(doc, "configMapGenerator")
+	if list == nil || list.Kind != yaml.SequenceNode {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		manifest.Set(doc, "configMapGenerator", list)
+	}
+
+	var changes []Change
+	for _, generatorName := range sortedGeneratorNames(generators) {
+		var entry *yaml.Node
+		for _, item := range list.Content {
+			if manifest.Scalar(item, "name") == generatorName {
+				entry = item
+				break
+			}
+		}
+		if entry == nil {
+			entry = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			manifest.SetScalar(entry, "name", generatorName)
+			list.Content = append(list.Content, entry)
+		}
+		for field, sources := range generators[generatorName] {
+			old := manifest.Get(entry, field)
+			if old != nil && sameSources(old, sources) {
+				continue
+			}
+			value, err := manifest.FromValue(sources)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Set(entry, field, value)
+			changes = append(changes, Change{File: kustomizationFile, Field: fmt.Sprintf("configMapGenerator[%s].%s", generatorName, field), New: fmt.Sprint(sources)})
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changes, file.Save()
+}
+
+func sortedGeneratorNames(generators map[string]map[string][]string) []string {
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sameSources(node *yaml.Node, sources []string) bool {
+	if node.Kind != yaml.SequenceNode || len(node.Content) != len(sources) {
+		return false
+	}
+	for i, item := range node.Content {
+		if item.Value != sources[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addListItem appends value to the list under key unless an item whose match
+// field (a scalar, or the name of a nested mapping) equals name already exists
+func addListItem(node *yaml.Node, key, match, name string, value interface{}) (bool, error) {
+	list := manifest.Get(node, key)
+	if list != nil && list.Kind == yaml.SequenceNode {
+		for _, item := range list.Content {
+			if manifest.Scalar(item, match) == name || manifest.Scalar(item, match, "name") == name {
+				return false, nil
+			}
+		}
+	} else {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		manifest.Set(node, key, list)
+	}
+	item, err := manifest.FromValue(value)
+	if err != nil {
+		return false, err
+	}
+	list.Content = append(list.Content, item)
+	return true, nil
+}
+
+type configMapEnvSource struct {
+	ConfigMapRef struct {
+		Name string `yaml:"name"`
+	} `yaml:"configMapRef"`
+}
+
+type configMapVolume struct {
+	Name      string `yaml:"name"`
+	ConfigMap struct {
+		Name string `yaml:"name"`
+	} `yaml:"configMap"`
+}
+
+type volumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`
+}
+
+// setVolumeMount adds the mount to the container or moves an existing mount of
+// the same volume, reporting whether anything changed
+func setVolumeMount(container *yaml.Node, mount volumeMount) (bool, error) {
+	if mounts := manifest.Get(container, "volumeMounts"); mounts != nil {
+		for _, item := range mounts.Content {
+			if manifest.Scalar(item, "name") == mount.Name {
+				return manifest.SetScalar(item, "mountPath", mount.MountPath) != mount.MountPath, nil
+			}
+		}
+	}
+	return addListItem(container, "volumeMounts", "name", mount.Name, mount)
+}
@@ -0,0 +1,239 @@
+package application
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
+	"gopkg.in/yaml.v3"
+)
+
+var containerNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Container is a sidecar or init container running next to the app's main
+// container
+type Container struct {
+	Name    string
+	Image   string
+	Port    int
+	Command []string
+	Init    bool
+}
+
+// ParseContainer parses a name=image container flag
+func ParseContainer(value string, init bool) (Container, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return Container{}, fmt.Errorf("invalid container %q, use name=image", value)
+	}
+	c := Container{Name: parts[0], Image: parts[1], Init: init}
+	return c, c.Validate()
+}
+
+// Validate checks the container name, image and port
+func (c Container) Validate() error {
+	if !containerNamePattern.MatchString(c.Name) || len(c.Name) > 63 {
+		return fmt.Errorf("invalid container name %q", c.Name)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d for container %s", c.Port, c.Name)
+	}
+	if c.Init && c.Port != 0 {
+		return fmt.Errorf("init container %s cannot expose a port", c.Name)
+	}
+	return ValidateImage(c.Image)
+}
+
+// MarshalYAML renders the container spec
+func (c Container) MarshalYAML() (interface{}, error) {
+	type containerPort struct {
+		ContainerPort int `yaml:"containerPort"`
+	}
+	spec := struct {
+		Name    string          `yaml:"name"`
+		Image   string          `yaml:"image"`
+		Command []string        `yaml:"command,omitempty"`
+		Ports   []containerPort `yaml:"ports,omitempty"`
+	}{Name: c.Name, Image: c.Image, Command: c.Command}
+	if c.Port != 0 {
+		spec.Ports = []containerPort{{c.Port}}
+	}
+	return spec, nil
+}
+
+// containerField returns the pod spec field holding the container
+func (c Container) containerField() string {
+	if c.Init {
+		return "initContainers"
+	}
+	return "containers"
+}
+
+// Sidecars returns the containers running next to the main container
+func (a *App) Sidecars() []Container {
+	var sidecars []Container
+	for _, c := range a.Containers {
+		if !c.Init {
+			sidecars = append(sidecars, c)
+		}
+	}
+	return sidecars
+}
+
+// InitContainers returns the containers running before the main container
+func (a *App) InitContainers() []Container {
+	var init []Container
+	for _, c := range a.Containers {
+		if c.Init {
+			init = append(init, c)
+		}
+	}
+	return init
+}
+
+// validateContainers checks the extra containers and that names are unique
+func (a *App) validateContainers() error {
+	names := map[string]bool{a.Name: true}
+	for _, c := range a.Containers {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		if names[c.Name] {
+			return fmt.Errorf("container %s is defined twice", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+// AddContainer adds a sidecar or init container to the overlay workload of an
+// app, the workload is left as it was when the overlay does not render
+func AddContainer(env, name string, c Container) ([]Change, error) {
+	undo := &rollback{}
+	changes, err := addContainer(env, name, c, undo)
+	if err != nil {
+		undo.restore()
+		return nil, err
+	}
+	return changes, nil
+}
+
+func addContainer(env, name string, c Container, undo *rollback) ([]Change, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	file, workload, err := loadOverlayWorkload(env, name)
+	if err != nil {
+		return nil, err
+	}
+	if c.Name == name {
+		return nil, fmt.Errorf("container %s is the main container of %s", c.Name, name)
+	}
+	if _, err := manifest.Container(workload, c.Name); err == nil {
+		return nil, fmt.Errorf("container %s already exists in %s", c.Name, file.Path)
+	}
+	node, err := manifest.FromValue(c)
+	if err != nil {
+		return nil, err
+	}
+	podSpec := manifest.PodSpec(workload)
+	list := manifest.Get(podSpec, c.containerField())
+	if list == nil || list.Kind != yaml.SequenceNode {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		manifest.Set(podSpec, c.containerField(), list)
+	}
+	list.Content = append(list.Content, node)
+	if err := saveOverlayWorkload(file, env, name, undo); err != nil {
+		return nil, err
+	}
+	return []Change{{File: file.Path, Field: fmt.Sprintf("%s[%s]", c.containerField(), c.Name), New: c.Image}}, nil
+}
+
+// RemoveContainer removes a sidecar or init container from the overlay
+// workload, the workload is left as it was when the overlay does not render
+func RemoveContainer(env, name, containerName string) ([]Change, error) {
+	undo := &rollback{}
+	changes, err := removeContainer(env, name, containerName, undo)
+	if err != nil {
+		undo.restore()
+		return nil, err
+	}
+	return changes, nil
+}
+
+func removeContainer(env, name, containerName string, undo *rollback) ([]Change, error) {
+	if containerName == name {
+		return nil, fmt.Errorf("container %s is the main container of %s and cannot be removed", containerName, name)
+	}
+	file, workload, err := loadOverlayWorkload(env, name)
+	if err != nil {
+		return nil, err
+	}
+	podSpec := manifest.PodSpec(workload)
+	for _, field := range []string{"containers", "initContainers"} {
+		list := manifest.Get(podSpec, field)
+		if list == nil {
+			continue
+		}
+		for i, item := range list.Content {
+			if manifest.Scalar(item, "name") != containerName {
+				continue
+			}
+			image := manifest.Scalar(item, "image")
+			list.Content = append(list.Content[:i], list.Content[i+1:]...)
+			if len(list.Content) == 0 && field == "initContainers" {
+				manifest.Delete(podSpec, field)
+			}
+			if err := saveOverlayWorkload(file, env, name, undo); err != nil {
+				return nil, err
+			}
+			return []Change{{File: file.Path, Field: fmt.Sprintf("%s[%s]", field, containerName), Old: image, New: "<removed>"}}, nil
+		}
+	}
+	return nil, fmt.Errorf("container %s not found in %s", containerName, file.Path)
+}
+
+func loadOverlayWorkload(env, name string) (*manifest.File, *yaml.Node, error) {
+	overlayPath := filepath.Join(config.AppTemplatePath, env, name)
+	exists, err := common.CheckFileExists(overlayPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, fmt.Errorf("app %s does not exist in %s, use app:create", name, env)
+	}
+	workloadFile, err := FindWorkloadFile(overlayPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := manifest.Load(workloadFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	workload := file.FindWorkload()
+	if workload == nil {
+		return nil, nil, fmt.Errorf("no workload found in %s", workloadFile)
+	}
+	return file, workload, nil
+}
+
+// saveOverlayWorkload saves the workload and checks that the overlay still
+// renders, undo restores the workload when it does not
+func saveOverlayWorkload(file *manifest.File, env, name string, undo *rollback) error {
+	if err := undo.track(file.Path); err != nil {
+		return err
+	}
+	if err := file.Save(); err != nil {
+		return err
+	}
+	overlayPath := filepath.Join(config.AppTemplatePath, env, name)
+	if _, err := render.Build(overlayPath); err != nil {
+		return fmt.Errorf("overlay %s does not render: %w", overlayPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,710 @@
+package application
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
+	"github.com/africhild/fleet-infra/src/secret"
+	"gopkg.in/yaml.v3"
+)
+
+// RegistrySecretName is the image pull secret every environment needs
+const RegistrySecretName = "registry-secret"
+
+var (
+	// envNamePattern matches the names usable as a namespace or directory
+	envNamePattern          = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	labelKeyPattern         = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]{0,251}[a-z0-9])?/)?[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+	labelValuePattern       = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+	resourceQuantityPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(m|k|M|G|T|P|E|Ki|Mi|Gi|Ti|Pi|Ei)?$`)
+)
+
+// namespaceTemplates are the Common templates env:update renders again
+var namespaceTemplates = []string{"namespace", "resource-quota", "limit-range"}
+
+// EnvironmentOptions are the settings of a new environment
+type EnvironmentOptions struct {
+	Name   string
+	Domain string
+	// Cluster is the directory under clusters Flux bootstraps the cluster from
+	Cluster       string
+	GitBranch     string
+	SecretBackend string
+	AgeRecipients []string
+	Namespace     config.NamespaceSettings
+}
+
+// NamespaceChanges are edits to the namespace settings of an environment, an
+// empty value removes the entry
+type NamespaceChanges struct {
+	Labels              map[string]string
+	Quota               map[string]string
+	LimitDefault        map[string]string
+	LimitDefaultRequest map[string]string
+	LimitMax            map[string]string
+	LimitMin            map[string]string
+}
+
+// Apply returns settings with the changes made
+func (c NamespaceChanges) Apply(settings config.NamespaceSettings) config.NamespaceSettings {
+	return config.NamespaceSettings{
+		Labels: mergeValues(settings.Labels, c.Labels),
+		Quota:  mergeValues(settings.Quota, c.Quota),
+		LimitRange: config.LimitRange{
+			Default:        mergeValues(settings.LimitRange.Default, c.LimitDefault),
+			DefaultRequest: mergeValues(settings.LimitRange.DefaultRequest, c.LimitDefaultRequest),
+			Max:            mergeValues(settings.LimitRange.Max, c.LimitMax),
+			Min:            mergeValues(settings.LimitRange.Min, c.LimitMin),
+		},
+	}
+}
+
+func mergeValues(values, changes map[string]string) map[string]string {
+	merged := make(map[string]string, len(values)+len(changes))
+	for key, value := range values {
+		merged[key] = value
+	}
+	for key, value := range changes {
+		if value == "" {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// validateNamespace checks the labels and quantities of namespace settings
+func validateNamespace(settings config.NamespaceSettings) error {
+	for key, value := range settings.Labels {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if !labelValuePattern.MatchString(value) {
+			return fmt.Errorf("invalid value %q of label %s", value, key)
+		}
+	}
+	quantities := map[string]map[string]string{
+		"quota":                     settings.Quota,
+		"limitRange.default":        settings.LimitRange.Default,
+		"limitRange.defaultRequest": settings.LimitRange.DefaultRequest,
+		"limitRange.max":            settings.LimitRange.Max,
+		"limitRange.min":            settings.LimitRange.Min,
+	}
+	for field, values := range quantities {
+		for resource, quantity := range values {
+			if !resourceQuantityPattern.MatchString(quantity) {
+				return fmt.Errorf("invalid quantity %q of %s %s", quantity, field, resource)
+			}
+		}
+	}
+	return nil
+}
+
+// EnvironmentResult lists what CreateEnvironment or DeleteEnvironment changed
+type EnvironmentResult struct {
+	// Written are the files created or edited
+	Written []string
+	Removed []string
+	// Notes are the steps left to do by hand
+	Notes []string
+}
+
+type fluxKustomization struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Interval  string `yaml:"interval"`
+		Path      string `yaml:"path"`
+		Prune     bool   `yaml:"prune"`
+		SourceRef struct {
+			Kind string `yaml:"kind"`
+			Name string `yaml:"name"`
+		} `yaml:"sourceRef"`
+	} `yaml:"spec"`
+}
+
+type registrySecret struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	StringData map[string]string `yaml:"stringData"`
+}
+
+// CreateEnvironment scaffolds an environment: its directory under apps with the
+// namespace, quota, limit range and ingress, the Flux Kustomization applying it
+// from clusters/<cluster> and its fleet.yaml entry. The registry pull secret is
+// left to the user, it is never written in clear.
+// Nothing is left behind when a step fails.
+func CreateEnvironment(templates []Template, options EnvironmentOptions, fleetConfig *config.FleetConfig) (*EnvironmentResult, error) {
+	undo := &rollback{}
+	result, err := createEnvironment(templates, options, fleetConfig, undo)
+	if err != nil {
+		undo.restore()
+		return nil, err
+	}
+	return result, nil
+}
+
+func createEnvironment(templates []Template, options EnvironmentOptions, fleetConfig *config.FleetConfig, undo *rollback) (*EnvironmentResult, error) {
+	envPath := filepath.Join(config.AppTemplatePath, options.Name)
+	if !envNamePattern.MatchString(options.Name) {
+		return nil, fmt.Errorf("invalid environment name %q, use lowercase letters, digits and -", options.Name)
+	}
+	if filepath.Clean(envPath) == filepath.Clean(basePath) {
+		return nil, fmt.Errorf("%s is reserved for bases and cannot be used as an environment", options.Name)
+	}
+	if !envNamePattern.MatchString(options.Cluster) {
+		return nil, fmt.Errorf("invalid cluster name %q, use lowercase letters, digits and -", options.Cluster)
+	}
+	exists, err := common.CheckFileExists(envPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("environment %s already exists in %s", options.Name, envPath)
+	}
+	settings := config.Environment{
+		Name:          options.Name,
+		Domain:        options.Domain,
+		GitBranch:     options.GitBranch,
+		SecretBackend: options.SecretBackend,
+		AgeRecipients: options.AgeRecipients,
+		Namespace:     options.Namespace,
+	}
+	// an entry written to fleet.yaml before the environment was created is
+	// used, the options only fill in what it leaves out
+	var entry *config.Environment
+	var filled []entryField
+	for i := range fleetConfig.Environments {
+		if fleetConfig.Environments[i].Name == options.Name {
+			entry = &fleetConfig.Environments[i]
+		}
+	}
+	if entry != nil {
+		settings = *entry
+		if filled, err = fillEntry(&settings, options); err != nil {
+			return nil, err
+		}
+	}
+	if settings.Domain == "" {
+		return nil, fmt.Errorf("the environment needs a domain")
+	}
+	if err := validateNamespace(settings.Namespace); err != nil {
+		return nil, err
+	}
+	clusterPath := filepath.Join(config.ClusterPath, options.Cluster)
+	fluxFile := filepath.Join(clusterPath, "apps-"+options.Name+".yaml")
+	exists, err = common.CheckFileExists(fluxFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%s already exists", fluxFile)
+	}
+
+	// the entry with defaults applied
+	environment := (&config.FleetConfig{Environments: []config.Environment{settings}}).Environment(options.Name)
+	backend, err := secret.NewBackend(environment)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EnvironmentResult{}
+	if err := undo.mkdir(envPath); err != nil {
+		return nil, err
+	}
+	app := &App{Env: options.Name, Namespace: options.Name, GitBranch: environment.GitBranch, Templates: templates, NamespaceSettings: settings.Namespace}
+	for _, tmpl := range templates {
+		if tmpl.Type != Common.String() {
+			continue
+		}
+		enabled, err := tmpl.Enabled(app)
+		if err != nil {
+			return nil, err
+		}
+		if !enabled {
+			continue
+		}
+		if err := app.createFile(tmpl, envPath); err != nil {
+			return nil, fmt.Errorf("error creating file for template %s: %w", tmpl.Name, err)
+		}
+		file, err := app.filePath(tmpl, envPath)
+		if err != nil {
+			return nil, err
+		}
+		result.Written = append(result.Written, file)
+	}
+
+	commonPath := filepath.Join(envPath, "common")
+	if err := common.EnsureDirectoryExists(commonPath); err != nil {
+		return nil, err
+	}
+	note, err := registrySecretNote(environment, backend, commonPath)
+	if err != nil {
+		return nil, err
+	}
+	result.Notes = append(result.Notes, note)
+	if backend.Name() == config.SealedSecretsBackend {
+		exists, err := common.CheckFileExists(environment.SealingCert)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			result.Notes = append(result.Notes, fmt.Sprintf("fetch the sealing certificate once the controller runs: fleet secret:cert fetch --env %s", options.Name))
+		}
+	}
+
+	if err := undo.mkdir(clusterPath); err != nil {
+		return nil, err
+	}
+	kustomizationFile := render.KustomizationFile(clusterPath)
+	if err := undo.track(fluxFile, config.FleetConfigFile); err != nil {
+		return nil, err
+	}
+	if err := writeFluxKustomization(fluxFile, options.Name); err != nil {
+		return nil, err
+	}
+	result.Written = append(result.Written, fluxFile)
+	if kustomizationFile != "" {
+		if err := undo.track(kustomizationFile); err != nil {
+			return nil, err
+		}
+		added, err := manifest.AddResource(kustomizationFile, filepath.Base(fluxFile))
+		if err != nil {
+			return nil, fmt.Errorf("error adding %s to %s: %w", fluxFile, kustomizationFile, err)
+		}
+		if added {
+			result.Written = append(result.Written, kustomizationFile)
+		}
+	}
+	// sops-age enables decryption on the Kustomization written above
+	if err := backend.Configure(environment); err != nil {
+		return nil, err
+	}
+	if environment.GitBranch != "main" {
+		result.Notes = append(result.Notes, fmt.Sprintf("%s reads the flux-system GitRepository, point it at a GitRepository of branch %s", fluxFile, environment.GitBranch))
+	}
+
+	if entry == nil {
+		if err := config.AddEnvironment(settings); err != nil {
+			return nil, fmt.Errorf("error adding %s to %s: %w", options.Name, config.FleetConfigFile, err)
+		}
+		result.Written = append(result.Written, config.FleetConfigFile)
+	} else {
+		for _, field := range filled {
+			if err := config.SetEnvironmentField(options.Name, field.key, field.value); err != nil {
+				return nil, fmt.Errorf("error setting %s of %s in %s: %w", field.key, options.Name, config.FleetConfigFile, err)
+			}
+		}
+		if len(filled) > 0 {
+			result.Written = append(result.Written, config.FleetConfigFile)
+		}
+		result.Notes = append(result.Notes, fmt.Sprintf("used the existing entry of %s in %s", options.Name, config.FleetConfigFile))
+	}
+
+	if _, err := render.Build(commonPath); err != nil {
+		return nil, fmt.Errorf("generated overlay %s does not render: %w", commonPath, err)
+	}
+	return result, nil
+}
+
+// entryField is a key fillEntry adds to the fleet.yaml entry of an environment
+type entryField struct {
+	key   string
+	value interface{}
+}
+
+// fillEntry sets the fields of an existing fleet.yaml entry the entry leaves
+// empty from the options and returns them. Options that contradict the entry
+// are an error, env:create does not overwrite settings.
+func fillEntry(entry *config.Environment, options EnvironmentOptions) ([]entryField, error) {
+	var filled []entryField
+	conflict := func(key string, value, option interface{}) error {
+		return fmt.Errorf("%s sets %s of %s to %v, not %v, edit it or leave out the option", config.FleetConfigFile, key, entry.Name, value, option)
+	}
+	for _, field := range []struct {
+		key    string
+		value  *string
+		option string
+	}{
+		{"domain", &entry.Domain, options.Domain},
+		{"gitBranch", &entry.GitBranch, options.GitBranch},
+		{"secretBackend", &entry.SecretBackend, options.SecretBackend},
+	} {
+		switch {
+		case field.option == "" || field.option == *field.value:
+		case *field.value == "":
+			*field.value = field.option
+			filled = append(filled, entryField{field.key, field.option})
+		default:
+			return nil, conflict(field.key, *field.value, field.option)
+		}
+	}
+	if len(options.AgeRecipients) > 0 {
+		switch {
+		case len(entry.AgeRecipients) == 0:
+			entry.AgeRecipients = options.AgeRecipients
+			filled = append(filled, entryField{"ageRecipients", options.AgeRecipients})
+		case !reflect.DeepEqual(entry.AgeRecipients, options.AgeRecipients):
+			return nil, conflict("ageRecipients", entry.AgeRecipients, options.AgeRecipients)
+		}
+	}
+	if options.Namespace.IsSet() {
+		switch {
+		case !entry.Namespace.IsSet():
+			entry.Namespace = options.Namespace
+			filled = append(filled, entryField{"namespace", options.Namespace})
+		case !reflect.DeepEqual(entry.Namespace, options.Namespace):
+			return nil, fmt.Errorf("%s sets the namespace settings of %s, change them with env:update after creating it", config.FleetConfigFile, entry.Name)
+		}
+	}
+	return filled, nil
+}
+
+// EnsureIngress renders the ingress of env from its template and lists it in
+// the common kustomization when the environment has none yet. The ingress is
+// created with its first rule, the API server rejects an Ingress without rules
+// or a default backend.
+func EnsureIngress(templates []Template, env string) error {
+	envPath := filepath.Join(config.AppTemplatePath, env)
+	app := &App{Env: env, Namespace: env, Templates: templates, Ingress: true}
+	for _, name := range []string{"common/kustomization", "common/ingress"} {
+		tmpl, err := findTemplate(templates, name)
+		if err != nil {
+			return err
+		}
+		if err := app.createFile(tmpl, envPath); err != nil {
+			return err
+		}
+	}
+	tmpl, err := findTemplate(templates, "common/ingress")
+	if err != nil {
+		return err
+	}
+	file, err := app.filePath(tmpl, envPath)
+	if err != nil {
+		return err
+	}
+	kustomizationFile := filepath.Join(filepath.Dir(file), "kustomization.yaml")
+	if _, err := manifest.AddResource(kustomizationFile, filepath.Base(file)); err != nil {
+		return fmt.Errorf("error adding %s to %s: %w", file, kustomizationFile, err)
+	}
+	return nil
+}
+
+// UpdateEnvironment saves the namespace settings of an environment to
+// fleet.yaml and renders its namespace, quota and limit range again. The quota
+// and limit range files are removed once their settings are empty.
+// Nothing is changed when a step fails.
+func UpdateEnvironment(templates []Template, name string, settings config.NamespaceSettings, fleetConfig *config.FleetConfig) (*EnvironmentResult, error) {
+	undo := &rollback{}
+	result, err := updateEnvironment(templates, name, settings, fleetConfig, undo)
+	if err != nil {
+		undo.restore()
+		return nil, err
+	}
+	return result, nil
+}
+
+func updateEnvironment(templates []Template, name string, settings config.NamespaceSettings, fleetConfig *config.FleetConfig, undo *rollback) (*EnvironmentResult, error) {
+	envPath, err := environmentPath(name)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := common.CheckFileExists(envPath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("environment %s does not exist, use env:create", name)
+	}
+	if err := validateNamespace(settings); err != nil {
+		return nil, err
+	}
+
+	result := &EnvironmentResult{}
+	environment := fleetConfig.Environment(name)
+	if !reflect.DeepEqual(environment.Namespace, settings) {
+		var value interface{}
+		if settings.IsSet() {
+			value = settings
+		}
+		if err := undo.track(config.FleetConfigFile); err != nil {
+			return nil, err
+		}
+		if err := config.SetEnvironmentField(name, "namespace", value); err != nil {
+			return nil, fmt.Errorf("error saving the namespace settings of %s: %w", name, err)
+		}
+		result.Written = append(result.Written, config.FleetConfigFile)
+	}
+
+	app := &App{Env: name, Namespace: name, GitBranch: environment.GitBranch, Templates: templates, NamespaceSettings: settings}
+	for _, tmpl := range templates {
+		if tmpl.Type != Common.String() || !containsString(namespaceTemplates, tmpl.Name) {
+			continue
+		}
+		file, err := app.filePath(tmpl, envPath)
+		if err != nil {
+			return nil, err
+		}
+		enabled, err := tmpl.Enabled(app)
+		if err != nil {
+			return nil, err
+		}
+		if err := undo.track(file); err != nil {
+			return nil, err
+		}
+		current, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if !enabled {
+			if current != nil {
+				if err := os.Remove(file); err != nil {
+					return nil, err
+				}
+				result.Removed = append(result.Removed, file)
+			}
+			continue
+		}
+		content, err := app.renderTemplate(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(current, content) {
+			continue
+		}
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			return nil, err
+		}
+		result.Written = append(result.Written, file)
+	}
+	return result, nil
+}
+
+// DeleteEnvironment removes the directory of an environment under apps, the
+// Flux Kustomizations applying it and its fleet.yaml entry. Environments with
+// app overlays are only removed when force is set. Bases, ports and
+// certificates are kept. Nothing is removed when a step fails.
+func DeleteEnvironment(name string, force bool) (*EnvironmentResult, error) {
+	undo := &rollback{}
+	result, err := deleteEnvironment(name, force, undo)
+	if err != nil {
+		undo.restore()
+		return nil, err
+	}
+	return result, nil
+}
+
+func deleteEnvironment(name string, force bool, undo *rollback) (*EnvironmentResult, error) {
+	envPath, err := environmentPath(name)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := common.CheckFileExists(envPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		apps, err := environmentApps(envPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(apps) > 0 && !force {
+			return nil, fmt.Errorf("environment %s still has apps: %s, remove them first or use --force", name, strings.Join(apps, ", "))
+		}
+	}
+
+	for _, dir := range []string{envPath, config.ClusterPath} {
+		if err := undo.snapshot(dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := undo.track(config.FleetConfigFile); err != nil {
+		return nil, err
+	}
+	result := &EnvironmentResult{}
+	found, err := removeFluxKustomizations(envPath, result)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if err := os.RemoveAll(envPath); err != nil {
+			return nil, err
+		}
+		result.Removed = append(result.Removed, envPath)
+	}
+	removed, err := config.RemoveEnvironment(name)
+	if err != nil {
+		return nil, fmt.Errorf("error removing %s from %s: %w", name, config.FleetConfigFile, err)
+	}
+	if removed {
+		result.Written = append(result.Written, config.FleetConfigFile)
+	}
+	if !exists && !found && !removed {
+		return nil, fmt.Errorf("environment %s does not exist", name)
+	}
+	if !found {
+		result.Notes = append(result.Notes, fmt.Sprintf("no Flux Kustomization with path ./%s found under %s", envPath, config.ClusterPath))
+	}
+	return result, nil
+}
+
+// environmentPath returns the directory of an existing or new environment
+func environmentPath(name string) (string, error) {
+	envPath := filepath.Join(config.AppTemplatePath, name)
+	if name == "" || filepath.Clean(envPath) == filepath.Clean(basePath) || filepath.Dir(filepath.Clean(envPath)) != filepath.Clean(config.AppTemplatePath) {
+		return "", fmt.Errorf("invalid environment name %q", name)
+	}
+	return envPath, nil
+}
+
+// environmentApps returns the app overlays in an environment directory
+func environmentApps(envPath string) ([]string, error) {
+	entries, err := os.ReadDir(envPath)
+	if err != nil {
+		return nil, err
+	}
+	var apps []string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != "common" && render.HasKustomization(filepath.Join(envPath, entry.Name())) {
+			apps = append(apps, entry.Name())
+		}
+	}
+	return apps, nil
+}
+
+// removeFluxKustomizations removes the Flux Kustomizations whose path is
+// envPath from the manifests under config.ClusterPath, reporting whether there
+// were any. Files left empty are deleted along with their entry in the
+// kustomization next to them.
+func removeFluxKustomizations(envPath string, result *EnvironmentResult) (bool, error) {
+	exists, err := common.CheckFileExists(config.ClusterPath)
+	if err != nil || !exists {
+		return false, err
+	}
+	found := false
+	err = filepath.Walk(config.ClusterPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+			return nil
+		}
+		file, err := manifest.Load(path)
+		if err != nil {
+			return err
+		}
+		var kept []*yaml.Node
+		for _, doc := range file.Docs {
+			if manifest.Kind(doc) == "Kustomization" &&
+				strings.HasPrefix(manifest.Scalar(doc, "apiVersion"), "kustomize.toolkit.fluxcd.io/") &&
+				filepath.Clean(manifest.Scalar(doc, "spec", "path")) == filepath.Clean(envPath) {
+				continue
+			}
+			kept = append(kept, doc)
+		}
+		if len(kept) == len(file.Docs) {
+			return nil
+		}
+		found = true
+		if len(kept) > 0 {
+			file.Docs = kept
+			result.Written = append(result.Written, path)
+			return file.Save()
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		result.Removed = append(result.Removed, path)
+		kustomizationFile := render.KustomizationFile(filepath.Dir(path))
+		if kustomizationFile == "" {
+			return nil
+		}
+		removed, err := manifest.RemoveResource(kustomizationFile, filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		if removed {
+			result.Written = append(result.Written, kustomizationFile)
+		}
+		return nil
+	})
+	return found, err
+}
+
+func writeFluxKustomization(path, env string) error {
+	kustomization := fluxKustomization{APIVersion: "kustomize.toolkit.fluxcd.io/v1", Kind: "Kustomization"}
+	kustomization.Metadata.Name = "apps-" + env
+	kustomization.Metadata.Namespace = "flux-system"
+	kustomization.Spec.Interval = "10m"
+	kustomization.Spec.Path = "./" + filepath.ToSlash(filepath.Join(config.AppTemplatePath, env))
+	kustomization.Spec.Prune = true
+	kustomization.Spec.SourceRef.Kind = "GitRepository"
+	kustomization.Spec.SourceRef.Name = "flux-system"
+	doc, err := manifest.FromValue(kustomization)
+	if err != nil {
+		return err
+	}
+	return (&manifest.File{Path: path, Docs: []*yaml.Node{doc}}).Save()
+}
+
+// registrySecretNote explains how to create the image pull secret of an
+// environment. The template is only printed, the credentials are piped straight
+// into the backend so the encrypted secret is the only file written.
+func registrySecretNote(environment config.Environment, backend secret.SecretBackend, commonPath string) (string, error) {
+	registry := strings.SplitN(config.ImageHost, "/", 2)[0]
+	template := registrySecret{APIVersion: "v1", Kind: "Secret", Type: "kubernetes.io/dockerconfigjson"}
+	template.Metadata.Name = RegistrySecretName
+	template.Metadata.Namespace = environment.Name
+	template.StringData = map[string]string{
+		".dockerconfigjson": fmt.Sprintf(`{"auths":{%q:{"auth":"<base64 user:token>"}}}`, registry),
+	}
+	doc, err := manifest.FromValue(template)
+	if err != nil {
+		return "", err
+	}
+	data, err := (&manifest.File{Docs: []*yaml.Node{doc}}).Bytes()
+	if err != nil {
+		return "", err
+	}
+	encrypted := filepath.Join(commonPath, RegistrySecretName+backend.FileSuffix())
+	kustomizationFile := filepath.Join(commonPath, "kustomization.yaml")
+	command := fmt.Sprintf("kubeseal --cert %s --format yaml > %s", environment.SealingCert, encrypted)
+	if backend.Name() == config.SopsAgeBackend {
+		command = fmt.Sprintf("sops --encrypt --input-type yaml --output-type yaml --encrypted-regex '^(data|stringData)$' --age %s /dev/stdin > %s",
+			strings.Join(environment.AgeRecipients, ","), encrypted)
+	}
+	return fmt.Sprintf("create the image pull secret %s without writing it to disk: fill in the credentials of the template below, pipe it to\n  %s\nand add %s to %s\n%s",
+		RegistrySecretName, command, filepath.Base(encrypted), kustomizationFile, strings.TrimRight(string(data), "\n")), nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
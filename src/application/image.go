@@ -0,0 +1,40 @@
+package application
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// imagePattern follows the docker reference grammar:
+// [registry[:port]/]path[:tag][@digest]
+var imagePattern = regexp.MustCompile(`^` +
+	`(?:[a-zA-Z0-9]+(?:[.-][a-zA-Z0-9]+)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?` +
+	`(?:@sha256:[a-f0-9]{64})?$`)
+
+// ValidateImage checks an image reference. Deployed images must be pinned, so a
+// tag or digest is required.
+func ValidateImage(image string) error {
+	if !imagePattern.MatchString(image) {
+		return fmt.Errorf("invalid image reference %q", image)
+	}
+	if !strings.Contains(image, "@") && !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+		return fmt.Errorf("image %s has no tag or digest", image)
+	}
+	return nil
+}
+
+// splitImage splits an image into its repository and the :tag and @digest
+// that follow it
+func splitImage(image string) (string, string) {
+	repository := image
+	if i := strings.Index(repository, "@"); i >= 0 {
+		repository = repository[:i]
+	}
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return repository, image[len(repository):]
+}
@@ -0,0 +1,484 @@
+package application
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Plan actions, in the order a plan lists them
+const (
+	PlanCreate = "create"
+	PlanUpdate = "update"
+	PlanDelete = "delete"
+)
+
+// FileChange is what applying the specs would do to one file
+type FileChange struct {
+	Action string
+	Path   string
+	// Changes are the fields apply reported for the file, if any
+	Changes []Change
+}
+
+// Plan is the drift between the repository and its app specs
+type Plan struct {
+	Files []FileChange
+	Notes []string
+	// Unmanaged are overlays no spec describes, plan leaves them alone
+	Unmanaged []string
+	// Drift are the fields of managed files that differ from what the
+	// templates render for the specs, like hand edits. Apply leaves them as
+	// they are.
+	Drift []FileChange
+}
+
+// HasChanges reports whether applying the specs would change any file
+func (p *Plan) HasChanges() bool {
+	return len(p.Files) > 0
+}
+
+// InSync reports whether the repository matches its app specs: nothing to
+// apply, no drift from the templates and no overlay without a spec
+func (p *Plan) InSync() bool {
+	return !p.HasChanges() && len(p.Drift) == 0 && len(p.Unmanaged) == 0
+}
+
+// Count returns the number of files with the given action
+func (p *Plan) Count(action string) int {
+	n := 0
+	for _, file := range p.Files {
+		if file.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// planPaths are the paths apply writes to, relative to the repository root
+func planPaths() []string {
+	return []string{config.AppTemplatePath, "ports.txt", config.FleetConfigFile}
+}
+
+// FindSpecs returns the app specs below root, hidden directories are skipped
+func FindSpecs(root string) ([]string, error) {
+	var specs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && d.Name() == SpecFile {
+			specs = append(specs, path)
+		}
+		return nil
+	})
+	return specs, err
+}
+
+// MakePlan applies the specs to a copy of the repository and compares the
+// result with the working tree, which is left untouched
+func MakePlan(specs []*Spec, templates []Template, fleetConfig *config.FleetConfig) (*Plan, error) {
+	names := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		if names[spec.Name] {
+			return nil, fmt.Errorf("app %s is described by more than one spec", spec.Name)
+		}
+		names[spec.Name] = true
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	workDir, err := os.MkdirTemp("", "fleet-plan-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+	for _, path := range planPaths() {
+		if err := copyPath(path, filepath.Join(workDir, path)); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &Plan{}
+	changes, err := applySpecs(workDir, specs, templates, fleetConfig, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := readTree(root)
+	if err != nil {
+		return nil, err
+	}
+	after, err := readTree(workDir)
+	if err != nil {
+		return nil, err
+	}
+	for path, content := range after {
+		old, exists := before[path]
+		switch {
+		case !exists:
+			plan.Files = append(plan.Files, FileChange{Action: PlanCreate, Path: path})
+		case !bytes.Equal(old, content):
+			plan.Files = append(plan.Files, FileChange{Action: PlanUpdate, Path: path})
+		}
+	}
+	for path := range before {
+		if _, exists := after[path]; !exists {
+			plan.Files = append(plan.Files, FileChange{Action: PlanDelete, Path: path})
+		}
+	}
+	order := map[string]int{PlanCreate: 0, PlanUpdate: 1, PlanDelete: 2}
+	sort.Slice(plan.Files, func(i, j int) bool {
+		if plan.Files[i].Action != plan.Files[j].Action {
+			return order[plan.Files[i].Action] < order[plan.Files[j].Action]
+		}
+		return plan.Files[i].Path < plan.Files[j].Path
+	})
+	for i := range plan.Files {
+		for _, change := range changes {
+			if filepath.Clean(change.File) == plan.Files[i].Path {
+				plan.Files[i].Changes = append(plan.Files[i].Changes, change)
+			}
+		}
+	}
+
+	plan.Unmanaged, err = unmanagedOverlays(specs)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// applySpecs applies the specs in dir and adds their notes and drift to plan.
+// Apply works on paths relative to the repository root, the working directory
+// and the logger are restored when it returns.
+func applySpecs(dir string, specs []*Spec, templates []Template, fleetConfig *config.FleetConfig, plan *Plan) ([]Change, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return nil, err
+	}
+	defer os.Chdir(cwd)
+	output := log.Out
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	var changes []Change
+	for _, spec := range specs {
+		result, err := Apply(spec, templates, fleetConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.Name, err)
+		}
+		drift, err := templateDrift(spec, templates, fleetConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.Name, err)
+		}
+		plan.Drift = append(plan.Drift, drift...)
+		changes = append(changes, result.Changes...)
+		plan.Notes = append(plan.Notes, result.Notes...)
+	}
+	return changes, nil
+}
+
+// templateDrift renders the base and overlay templates of the spec and
+// compares them with the applied files. Only what the templates render is
+// compared, fields added by other commands are not drift. The image tag and
+// the replica count are left out when the spec does not manage them.
+func templateDrift(spec *Spec, templates []Template, fleetConfig *config.FleetConfig) ([]FileChange, error) {
+	var drift []FileChange
+	baseChecked := false
+	for _, env := range spec.EnvironmentNames() {
+		app, err := spec.App(env, templates, fleetConfig.Environment(env))
+		if err != nil {
+			return nil, err
+		}
+		envPath := filepath.Join(config.AppTemplatePath, env)
+		relBase, err := filepath.Rel(filepath.Join(envPath, app.Name), filepath.Join(basePath, app.Name))
+		if err != nil {
+			return nil, err
+		}
+		app.BasePath = filepath.ToSlash(relBase)
+		envSpec := spec.Environments[env]
+		ignored := map[string]bool{}
+		if envSpec.Tag == "" {
+			ignored[fmt.Sprintf("spec.template.spec.containers[%s].image", app.Name)] = true
+			ignored[fmt.Sprintf("spec.jobTemplate.spec.template.spec.containers[%s].image", app.Name)] = true
+		}
+		if envSpec.Replicas == nil {
+			ignored["spec.replicas"] = true
+		}
+
+		for _, tmpl := range templates {
+			// the base is shared, it is compared once
+			if tmpl.Type == Common.String() || (tmpl.Type == Base.String() && baseChecked) {
+				continue
+			}
+			enabled, err := tmpl.Enabled(app)
+			if err != nil {
+				return nil, err
+			}
+			if !enabled {
+				continue
+			}
+			file, err := app.filePath(tmpl, envPath)
+			if err != nil {
+				return nil, err
+			}
+			content, err := app.renderTemplate(tmpl)
+			if err != nil {
+				return nil, err
+			}
+			changes, err := fileDrift(file, content, ignored)
+			if err != nil {
+				return nil, err
+			}
+			if len(changes) > 0 {
+				drift = append(drift, FileChange{Action: PlanUpdate, Path: file, Changes: changes})
+			}
+		}
+		baseChecked = true
+	}
+	return drift, nil
+}
+
+// fileDrift compares the documents of file with the rendered ones
+func fileDrift(file string, rendered []byte, ignored map[string]bool) ([]Change, error) {
+	wanted, err := decodeDocuments(rendered)
+	if err != nil {
+		return nil, fmt.Errorf("template of %s does not parse: %w", file, err)
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return []Change{{File: file, Field: "file", New: "<missing>"}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	actual, err := decodeDocuments(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	var changes []Change
+	for i, doc := range wanted {
+		var current interface{}
+		if i < len(actual) {
+			current = actual[i]
+		}
+		changes = append(changes, valueDrift(file, "", doc, current, ignored)...)
+	}
+	return changes, nil
+}
+
+func decodeDocuments(data []byte) ([]interface{}, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	var docs []interface{}
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+}
+
+// valueDrift reports where actual lacks or differs from wanted. Mappings may
+// hold more keys than wanted and lists more items, list items with a name are
+// matched by name.
+func valueDrift(file, field string, wanted, actual interface{}, ignored map[string]bool) []Change {
+	if ignored[field] {
+		return nil
+	}
+	switch wanted := wanted.(type) {
+	case map[string]interface{}:
+		current, ok := actual.(map[string]interface{})
+		if !ok {
+			return []Change{{File: file, Field: field, Old: describeValue(actual), New: describeValue(wanted)}}
+		}
+		keys := make([]string, 0, len(wanted))
+		for key := range wanted {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var changes []Change
+		for _, key := range keys {
+			child := key
+			if field != "" {
+				child = field + "." + key
+			}
+			changes = append(changes, valueDrift(file, child, wanted[key], current[key], ignored)...)
+		}
+		return changes
+	case []interface{}:
+		current, ok := actual.([]interface{})
+		if !ok {
+			return []Change{{File: file, Field: field, Old: describeValue(actual), New: describeValue(wanted)}}
+		}
+		var changes []Change
+		for i, item := range wanted {
+			name, named := itemName(item)
+			if !named {
+				if !containsValue(current, item) {
+					changes = append(changes, Change{File: file, Field: fmt.Sprintf("%s[%d]", field, i), New: describeValue(item)})
+				}
+				continue
+			}
+			var match interface{}
+			for _, candidate := range current {
+				if candidateName, ok := itemName(candidate); ok && candidateName == name {
+					match = candidate
+					break
+				}
+			}
+			changes = append(changes, valueDrift(file, fmt.Sprintf("%s[%s]", field, name), item, match, ignored)...)
+		}
+		return changes
+	default:
+		if actual == nil || fmt.Sprint(actual) != fmt.Sprint(wanted) {
+			return []Change{{File: file, Field: field, Old: describeValue(actual), New: describeValue(wanted)}}
+		}
+		return nil
+	}
+}
+
+func itemName(item interface{}) (string, bool) {
+	mapping, ok := item.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	name, ok := mapping["name"].(string)
+	return name, ok
+}
+
+// containsValue reports whether a list item matches wanted without drift
+func containsValue(items []interface{}, wanted interface{}) bool {
+	for _, item := range items {
+		if len(valueDrift("", "", wanted, item, nil)) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func describeValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(data)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// unmanagedOverlays returns the app overlays no spec describes
+func unmanagedOverlays(specs []*Spec) ([]string, error) {
+	managed := make(map[string]bool)
+	for _, spec := range specs {
+		for env := range spec.Environments {
+			managed[filepath.Join(config.AppTemplatePath, env, spec.Name)] = true
+		}
+	}
+	envs, err := os.ReadDir(config.AppTemplatePath)
+	if err != nil {
+		return nil, err
+	}
+	var unmanaged []string
+	for _, env := range envs {
+		if !env.IsDir() || filepath.Join(config.AppTemplatePath, env.Name()) == config.BaseTemplatePath {
+			continue
+		}
+		apps, err := os.ReadDir(filepath.Join(config.AppTemplatePath, env.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			overlay := filepath.Join(config.AppTemplatePath, env.Name(), app.Name())
+			if app.IsDir() && app.Name() != "common" && !managed[overlay] {
+				unmanaged = append(unmanaged, overlay)
+			}
+		}
+	}
+	return unmanaged, nil
+}
+
+// readTree returns the content of the plan paths below dir by relative path
+func readTree(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, path := range planPaths() {
+		err := filepath.WalkDir(filepath.Join(dir, path), func(file string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, file)
+			if err != nil {
+				return err
+			}
+			files[rel], err = os.ReadFile(file)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// copyPath copies a file or directory tree, a missing src is skipped
+func copyPath(src, dst string) error {
+	exists, err := common.CheckFileExists(src)
+	if err != nil || !exists {
+		return err
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
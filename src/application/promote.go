@@ -0,0 +1,322 @@
+package application
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/ingress"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
+	"github.com/africhild/fleet-infra/src/secret"
+	"gopkg.in/yaml.v3"
+)
+
+// PromoteResult describes what Promote wrote to the target environment
+type PromoteResult struct {
+	Files []string
+	Image string
+	Hosts []string
+	// UnmappedHosts are source hosts outside the source environment's domain,
+	// they have to be added to the target ingress by hand
+	UnmappedHosts []string
+	// Secrets are encrypted for the source cluster and were not copied
+	Secrets []secret.SealedSecret
+	// UndefinedSecrets are referenced by the promoted workloads but defined
+	// neither in the overlay nor in Secrets, they have to exist in the target
+	// namespace before the app starts
+	UndefinedSecrets []string
+}
+
+// Promote copies the overlay of an app from one environment to another. The
+// target gets the image deployed in the source, its own namespace and hosts on
+// its own domain. Encrypted secrets cannot be decrypted by the target cluster,
+// they are left out and returned so they can be created again. Nothing is
+// left behind when the promoted overlay does not render.
+func Promote(templates []Template, name, from, to string, fleetConfig *config.FleetConfig) (*PromoteResult, error) {
+	undo := &rollback{}
+	result, err := promote(templates, name, from, to, fleetConfig, undo)
+	if err != nil {
+		undo.restore()
+		return nil, err
+	}
+	return result, nil
+}
+
+func promote(templates []Template, name, from, to string, fleetConfig *config.FleetConfig, undo *rollback) (*PromoteResult, error) {
+	if from == to {
+		return nil, fmt.Errorf("source and target environment are both %s", from)
+	}
+	envPath := filepath.Join(config.AppTemplatePath, to)
+	if filepath.Clean(envPath) == filepath.Clean(basePath) {
+		return nil, fmt.Errorf("%s is reserved for bases and cannot be used as an environment", to)
+	}
+	source := filepath.Join(config.AppTemplatePath, from, name)
+	target := filepath.Join(envPath, name)
+	exists, err := common.CheckFileExists(source)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("app %s does not exist in %s", name, from)
+	}
+	exists, err = common.CheckFileExists(target)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("app %s already exists in %s, use app:update", name, to)
+	}
+
+	result := &PromoteResult{}
+	result.Secrets, err = secret.FindEncryptedSecrets(source)
+	if err != nil {
+		return nil, err
+	}
+	// collect the files first so nothing is written when one fails to parse
+	files := make(map[string][]byte)
+	var dropped []string
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		data, err := promoteFile(path, from, to)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			dropped = append(dropped, filepath.ToSlash(rel))
+			return nil
+		}
+		files[rel] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := files["kustomization.yaml"]; ok {
+		files["kustomization.yaml"], err = dropResources(data, dropped)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the target environment may not have its namespace and ingress yet
+	targetEnv := fleetConfig.Environment(to)
+	scaffold := &App{Name: name, Namespace: to, Env: to, Templates: templates, GitBranch: targetEnv.GitBranch, NamespaceSettings: targetEnv.Namespace}
+	_, scaffold.ImageAutomation = files["image-automation.yaml"]
+	if err := undo.mkdir(target); err != nil {
+		return nil, err
+	}
+	if err := undo.mkdir(filepath.Join(envPath, "common")); err != nil {
+		return nil, err
+	}
+	for _, tmpl := range templates {
+		if tmpl.Type != Common.String() {
+			continue
+		}
+		path, err := scaffold.filePath(tmpl, envPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := undo.track(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, tmpl := range templates {
+		enabled, err := tmpl.Enabled(scaffold)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl.Type != Common.String() || !enabled {
+			continue
+		}
+		if err := scaffold.createFile(tmpl, envPath); err != nil {
+			return nil, fmt.Errorf("error creating file for template %s: %w", tmpl.Name, err)
+		}
+	}
+	if scaffold.ImageAutomation {
+		commonKustomization := filepath.Join(envPath, "common", "kustomization.yaml")
+		if _, err := manifest.AddResource(commonKustomization, "image-update-automation.yaml"); err != nil {
+			return nil, err
+		}
+	}
+
+	for rel, data := range files {
+		path := filepath.Join(target, rel)
+		if err := common.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return nil, err
+		}
+		result.Files = append(result.Files, path)
+	}
+	sort.Strings(result.Files)
+
+	if workloadFile, err := FindWorkloadFile(target); err == nil {
+		if file, err := manifest.Load(workloadFile); err == nil {
+			if workload := file.FindWorkload(); workload != nil {
+				if container, err := mainContainer(workload, name); err == nil {
+					result.Image = manifest.Scalar(container, "image")
+				}
+			}
+		}
+	}
+
+	hosts, err := ingress.Hosts(from, name)
+	if err != nil {
+		return nil, err
+	}
+	sourceEnv := fleetConfig.Environment(from)
+	for _, host := range hosts {
+		subdomain, ok := sourceEnv.Subdomain(host)
+		if !ok {
+			result.UnmappedHosts = append(result.UnmappedHosts, host)
+			continue
+		}
+		targetHost := targetEnv.Host(subdomain)
+		if err := EnsureIngress(templates, to); err != nil {
+			return nil, err
+		}
+		if _, err := ingress.AddRule(to, targetHost, name, 80); err != nil {
+			return nil, err
+		}
+		result.Hosts = append(result.Hosts, targetHost)
+	}
+
+	rendered, err := render.Build(target)
+	if err != nil {
+		return nil, fmt.Errorf("promoted overlay %s does not render: %w", target, err)
+	}
+	undefined, err := secret.UndefinedSecrets(rendered)
+	if err != nil {
+		return nil, err
+	}
+	recreated := make(map[string]bool, len(result.Secrets))
+	for _, s := range result.Secrets {
+		recreated[s.SecretName()] = true
+	}
+	for _, secretName := range undefined {
+		if !recreated[secretName] {
+			result.UndefinedSecrets = append(result.UndefinedSecrets, secretName)
+		}
+	}
+	return result, nil
+}
+
+// promoteFile returns the content of an overlay file for the target
+// environment, or nil when the file only holds encrypted secrets
+func promoteFile(path, from, to string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".yaml" && ext != ".yml" {
+		return data, nil
+	}
+	file, err := manifest.Parse(path, data)
+	if err != nil {
+		return nil, err
+	}
+	var docs []*yaml.Node
+	changed := false
+	for _, doc := range file.Docs {
+		if isEncryptedSecret(doc) {
+			changed = true
+			continue
+		}
+		if manifest.Kind(doc) == "Kustomization" && manifest.Scalar(doc, "namespace") == from {
+			manifest.SetScalar(doc, "namespace", to)
+			changed = true
+		}
+		if manifest.Scalar(doc, "metadata", "namespace") == from {
+			manifest.SetScalar(manifest.Get(doc, "metadata"), "namespace", to)
+			changed = true
+		}
+		if filterTags := manifest.Get(doc, "spec", "filterTags"); manifest.Kind(doc) == "ImagePolicy" && filterTags != nil {
+			// timestamp policies match the tags ci pushes for the environment
+			pattern := manifest.Scalar(filterTags, "pattern")
+			if strings.HasPrefix(pattern, "^"+from+"-") {
+				manifest.SetScalar(filterTags, "pattern", "^"+to+"-"+strings.TrimPrefix(pattern, "^"+from+"-"))
+				changed = true
+			}
+		}
+		// image policies live in the app namespace, so do their setter markers
+		for _, container := range containerNodes(doc) {
+			image := manifest.Get(container, "image")
+			marker := fmt.Sprintf(`"$imagepolicy": "%s:`, from)
+			if image != nil && strings.Contains(image.LineComment, marker) {
+				image.LineComment = strings.Replace(image.LineComment, marker, fmt.Sprintf(`"$imagepolicy": "%s:`, to), 1)
+				changed = true
+			}
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	if !changed {
+		return data, nil
+	}
+	file.Docs = docs
+	return file.Bytes()
+}
+
+// containerNodes returns the containers of a workload document, nil for others
+func containerNodes(doc *yaml.Node) []*yaml.Node {
+	for _, kind := range manifest.WorkloadKinds {
+		if manifest.Kind(doc) == kind {
+			return manifest.Containers(doc)
+		}
+	}
+	return nil
+}
+
+func isEncryptedSecret(doc *yaml.Node) bool {
+	switch manifest.Kind(doc) {
+	case "SealedSecret":
+		return true
+	case "Secret":
+		return manifest.Get(doc, "sops") != nil
+	}
+	return false
+}
+
+// dropResources removes the dropped files from the resources of a kustomization
+func dropResources(data []byte, dropped []string) ([]byte, error) {
+	if len(dropped) == 0 {
+		return data, nil
+	}
+	file, err := manifest.Parse("kustomization.yaml", data)
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[string]bool, len(dropped))
+	for _, rel := range dropped {
+		skip[rel] = true
+	}
+	for _, doc := range file.Docs {
+		resources := manifest.Get(doc, "resources")
+		if resources == nil {
+			continue
+		}
+		var kept []*yaml.Node
+		for _, resource := range resources.Content {
+			if !skip[strings.TrimPrefix(resource.Value, "./")] {
+				kept = append(kept, resource)
+			}
+		}
+		resources.Content = kept
+	}
+	return file.Bytes()
+}
@@ -0,0 +1,128 @@
+package application
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/africhild/fleet-infra/src/common"
+)
+
+// rollback undoes the file changes of a command that fails halfway, so the
+// repository is left as it was
+type rollback struct {
+	files   []string
+	content map[string][]byte // nil when the file did not exist
+	dirs    []string
+	// trees are snapshotted directories, existing what they held
+	trees    []string
+	existing map[string]bool
+	// treeDirs are the directories found by snapshot, restore creates them
+	// again when they were removed
+	treeDirs []string
+}
+
+// track records the current content of paths, call it before writing them
+func (r *rollback) track(paths ...string) error {
+	if r.content == nil {
+		r.content = make(map[string][]byte)
+	}
+	for _, path := range paths {
+		if _, ok := r.content[path]; ok {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.content[path] = data
+		r.files = append(r.files, path)
+	}
+	return nil
+}
+
+// mkdir creates dir with its parents, the ones it creates are removed by restore
+func (r *rollback) mkdir(dir string) error {
+	missing := ""
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		exists, err := common.CheckFileExists(d)
+		if err != nil {
+			return err
+		}
+		if exists {
+			break
+		}
+		missing = d
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := common.EnsureDirectoryExists(dir); err != nil {
+		return err
+	}
+	if missing != "" {
+		r.dirs = append(r.dirs, missing)
+	}
+	return nil
+}
+
+// snapshot tracks every file below dir, restore also removes the files and
+// directories created below it afterwards
+func (r *rollback) snapshot(dir string) error {
+	if r.existing == nil {
+		r.existing = make(map[string]bool)
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.existing[path] = true
+		if info.IsDir() {
+			r.treeDirs = append(r.treeDirs, path)
+			return nil
+		}
+		return r.track(path)
+	})
+	if err != nil {
+		return err
+	}
+	r.trees = append(r.trees, dir)
+	return nil
+}
+
+// restore puts the tracked files back and removes the created directories,
+// in reverse order
+func (r *rollback) restore() {
+	for _, dir := range r.treeDirs {
+		os.MkdirAll(dir, 0755)
+	}
+	for i := len(r.files) - 1; i >= 0; i-- {
+		path := r.files[i]
+		if r.content[path] == nil {
+			os.Remove(path)
+			continue
+		}
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, r.content[path], 0644)
+	}
+	for i := len(r.dirs) - 1; i >= 0; i-- {
+		os.RemoveAll(r.dirs[i])
+	}
+	for _, tree := range r.trees {
+		filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
+			if err != nil || r.existing[path] {
+				return nil
+			}
+			if _, tracked := r.content[path]; tracked {
+				return nil
+			}
+			os.RemoveAll(path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package application
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/config"
+)
+
+var (
+	cpuPattern    = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?m?$`)
+	memoryPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(Ki|Mi|Gi|Ti|k|M|G|T)?$`)
+)
+
+// ResourceList holds cpu and memory quantities
+type ResourceList struct {
+	CPU    string `yaml:"cpu,omitempty"`
+	Memory string `yaml:"memory,omitempty"`
+}
+
+// Resources holds the requests and limits of the main container
+type Resources struct {
+	Requests ResourceList `yaml:"requests,omitempty"`
+	Limits   ResourceList `yaml:"limits,omitempty"`
+}
+
+// IsSet reports whether any request or limit is set
+func (r Resources) IsSet() bool {
+	return r.Requests != ResourceList{} || r.Limits != ResourceList{}
+}
+
+// Validate checks the cpu and memory quantities
+func (r Resources) Validate() error {
+	for _, cpu := range []string{r.Requests.CPU, r.Limits.CPU} {
+		if cpu != "" && !cpuPattern.MatchString(cpu) {
+			return fmt.Errorf("invalid cpu quantity %q", cpu)
+		}
+	}
+	for _, memory := range []string{r.Requests.Memory, r.Limits.Memory} {
+		if memory != "" && !memoryPattern.MatchString(memory) {
+			return fmt.Errorf("invalid memory quantity %q", memory)
+		}
+	}
+	return nil
+}
+
+// SecurityContext holds the container security settings
+type SecurityContext struct {
+	RunAsNonRoot           bool
+	ReadOnlyRootFilesystem bool
+}
+
+// IsSet reports whether any security setting is enabled
+func (s SecurityContext) IsSet() bool {
+	return s.RunAsNonRoot || s.ReadOnlyRootFilesystem
+}
+
+// MarshalYAML renders the container securityContext, privilege escalation is
+// always disabled once a security setting is enabled
+func (s SecurityContext) MarshalYAML() (interface{}, error) {
+	return struct {
+		RunAsNonRoot             bool `yaml:"runAsNonRoot,omitempty"`
+		ReadOnlyRootFilesystem   bool `yaml:"readOnlyRootFilesystem,omitempty"`
+		AllowPrivilegeEscalation bool `yaml:"allowPrivilegeEscalation"`
+	}{s.RunAsNonRoot, s.ReadOnlyRootFilesystem, false}, nil
+}
+
+// Autoscale holds the bounds and cpu target of the horizontal pod autoscaler
+type Autoscale struct {
+	Min int
+	Max int
+	CPU int // average utilization in percent
+}
+
+// ParseAutoscale parses min:max:cpu%, the % is optional
+func ParseAutoscale(value string) (Autoscale, error) {
+	parts := strings.Split(strings.TrimSuffix(value, "%"), ":")
+	if len(parts) != 3 {
+		return Autoscale{}, fmt.Errorf("invalid autoscale %q, use min:max:cpu%%", value)
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return Autoscale{}, fmt.Errorf("invalid autoscale %q, use min:max:cpu%%", value)
+		}
+		numbers[i] = n
+	}
+	a := Autoscale{Min: numbers[0], Max: numbers[1], CPU: numbers[2]}
+	return a, a.Validate()
+}
+
+// IsSet reports whether autoscaling is enabled
+func (a Autoscale) IsSet() bool {
+	return a != Autoscale{}
+}
+
+// Validate checks the bounds and cpu target
+func (a Autoscale) Validate() error {
+	if !a.IsSet() {
+		return nil
+	}
+	if a.Min < 1 || a.Max < a.Min {
+		return fmt.Errorf("invalid autoscale bounds %d:%d", a.Min, a.Max)
+	}
+	// the target is relative to the cpu request and may go past 100%
+	if a.CPU < 1 {
+		return fmt.Errorf("invalid autoscale cpu target %d%%", a.CPU)
+	}
+	return nil
+}
+
+// ApplyDefaults fills the probe, resource and security settings the app does
+// not set from the environment defaults. Default probes go to the overlay, the
+// base only gets the probes of the app.
+func (a *App) ApplyDefaults(defaults config.AppDefaults) {
+	setDefault := func(value *string, fallback string) {
+		if *value == "" {
+			*value = fallback
+		}
+	}
+	if a.ExposesPort() {
+		if a.ReadinessPath == "" {
+			a.EnvReadinessPath = defaults.ReadinessPath
+		}
+		if a.LivenessPath == "" {
+			a.EnvLivenessPath = defaults.LivenessPath
+		}
+	}
+	setDefault(&a.Resources.Requests.CPU, defaults.CPURequest)
+	setDefault(&a.Resources.Requests.Memory, defaults.MemoryRequest)
+	setDefault(&a.Resources.Limits.CPU, defaults.CPULimit)
+	setDefault(&a.Resources.Limits.Memory, defaults.MemoryLimit)
+	a.SecurityContext.RunAsNonRoot = a.SecurityContext.RunAsNonRoot || defaults.RunAsNonRoot
+	a.SecurityContext.ReadOnlyRootFilesystem = a.SecurityContext.ReadOnlyRootFilesystem || defaults.ReadOnlyRootFilesystem
+}
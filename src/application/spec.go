@@ -0,0 +1,102 @@
+package application
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SpecFile is the default name of an app spec
+const SpecFile = "fleet-app.yaml"
+
+// Spec is the declarative definition of an app, the record of what app:create
+// flags would otherwise only pass once
+type Spec struct {
+	Name string `yaml:"name"`
+	Kind string `yaml:"kind,omitempty"`
+	Port int    `yaml:"port,omitempty"`
+	// Image is the repository without tag, default <ImageHost>/<name>
+	Image         string    `yaml:"image,omitempty"`
+	Schedule      string    `yaml:"schedule,omitempty"`
+	StorageSize   string    `yaml:"storageSize,omitempty"`
+	ReadinessPath string    `yaml:"readinessPath,omitempty"`
+	LivenessPath  string    `yaml:"livenessPath,omitempty"`
+	Resources     Resources `yaml:"resources,omitempty"`
+	// Environments maps the environment name to its settings
+	Environments map[string]EnvironmentSpec `yaml:"environments"`
+}
+
+// EnvironmentSpec holds the settings of an app in one environment
+type EnvironmentSpec struct {
+	Replicas *int   `yaml:"replicas,omitempty"`
+	Tag      string `yaml:"tag,omitempty"`
+	// Autoscale is min:max:cpu%, it replaces Replicas
+	Autoscale string `yaml:"autoscale,omitempty"`
+	// Hosts are subdomains of the environment's domain, @ is the domain itself.
+	// When set, ingress rules of the app for other hosts are removed.
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Resources override the app resources in this environment
+	Resources *Resources `yaml:"resources,omitempty"`
+	// Secrets are checked, not created, plaintext never goes into the spec
+	Secrets []SecretSpec `yaml:"secrets,omitempty"`
+}
+
+// SecretSpec names a secret the app needs and the keys it must hold
+type SecretSpec struct {
+	Name string   `yaml:"name"`
+	Keys []string `yaml:"keys,omitempty"`
+}
+
+// LoadSpec reads and validates an app spec
+func LoadSpec(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{}
+	if err := yaml.UnmarshalStrict(data, spec); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid spec %s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// Validate checks the spec, the kind specific settings are checked per
+// environment by App.Validate
+func (s *Spec) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(s.Environments) == 0 {
+		return fmt.Errorf("no environments")
+	}
+	for _, env := range s.EnvironmentNames() {
+		envSpec := s.Environments[env]
+		if envSpec.Replicas != nil && envSpec.Autoscale != "" {
+			return fmt.Errorf("%s: set either replicas or autoscale", env)
+		}
+		if envSpec.Autoscale != "" {
+			if _, err := ParseAutoscale(envSpec.Autoscale); err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+		}
+		if envSpec.Tag != "" && !tagPattern.MatchString(envSpec.Tag) {
+			return fmt.Errorf("%s: invalid image tag %q", env, envSpec.Tag)
+		}
+	}
+	return nil
+}
+
+// EnvironmentNames returns the environments of the spec in a stable order
+func (s *Spec) EnvironmentNames() []string {
+	names := make([]string, 0, len(s.Environments))
+	for name := range s.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,116 +1,40 @@
 package application
 
 import (
+	"embed"
 	"fmt"
-)
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
 
-// Template constants
-const (
-	BaseDeploymentTmpl = `
-apiVersion: apps/v1
-kind: Deployment
-metadata:
-  name: {{.Name}}
-  labels:
-    app: {{.Name}}
-  namespace: default
-spec:
-  replicas: 1
-  selector:
-    matchLabels:
-      app: {{.Name}}
-  template:
-    metadata:
-      labels:
-        app: {{.Name}}
-    spec:
-      containers:
-      - name: {{.Name}}
-        ports:
-        - containerPort: {{.Port}}
-`
-
-	BaseServiceTmpl = `
-apiVersion: v1
-kind: Service
-metadata:
-  name: {{.Name}}
-  labels:
-    app: {{.Name}}
-  namespace: default
-spec:
-  selector:
-    app: {{.Name}}
-  ports:
-  - protocol: TCP
-    port: 80
-    targetPort: {{.Port}}
-  type: ClusterIP
-`
-
-BaseKustomizationTmpl = `
-apiVersion: kustomize.config.k8s.io/v1beta1
-kind: Kustomization
-resources:
-- deployment.yaml
-- service.yaml
-`
-
-DeploymentTmpl = `
-apiVersion: apps/v1
-kind: Deployment
-metadata:
-  name: {{.Name}}
-spec:
-  replicas: {{.Replicas}}
-  selector:
-    matchLabels:
-      app: {{.Name}}
-  template:
-    spec:
-      containers:
-      - name: {{.Name}}
-        image: {{.Image}}
-      imagePullSecrets:
-        - name: registry-secret
-`
-
-KustomizationTmpl = `
-apiVersion: kustomize.config.k8s.io/v1beta1
-kind: Kustomization
-namespace: {{.Namespace}}
-resources:
-- ../../../../../base/{{.Name}}
-patches:
-  - path: deployment.yaml
-`
-NamespaseTmpl = `
-apiVersion: v1
-kind: Namespace
-metadata: 
-  name: {{.Namespace}}
-`
-IngressKustomizationTmpl = `
-apiVersion: kustomize.config.k8s.io/v1beta1
-kind: Kustomization
-namespace: {{.Namespace}}
-resources:
-- ingress.yaml
-`
-IngressTmpl = `
-apiVersion: networking.k8s.io/v1
-kind: Ingress
-metadata:
-  name: {{.Namespace}}-ingress
-  namespace: {{.Namespace}}
-  annotations:
-    nginx.ingress.kubernetes.io/rewrite-target: /
-spec:
-  ingressClassName: nginx
-  rules: []
-`
+	"github.com/africhild/fleet-infra/src/common"
+	"gopkg.in/yaml.v2"
 )
 
+// defaultTemplates holds the templates compiled into the binary
+//
+//go:embed templates
+var defaultTemplates embed.FS
+
+const manifestFile = "manifest.yaml"
+
+// templateFuncs are available to every template
+var templateFuncs = template.FuncMap{
+	// toYaml renders a value as a yaml block
+	"toYaml": func(value interface{}) (string, error) {
+		out, err := yaml.Marshal(value)
+		return strings.TrimSuffix(string(out), "\n"), err
+	},
+	// indent prefixes every line of text with n spaces
+	"indent": func(n int, text string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(text, "\n", "\n"+pad)
+	},
+}
+
 // ResourceType represents the type of resource
 type ResourceType int
 
@@ -150,66 +74,136 @@ func (r ResourceType) String() string {
 	return "unknown"
 }
 
+// ParseResourceType returns the ResourceType called name
+func ParseResourceType(name string) (ResourceType, error) {
+	for r, resource := range resources {
+		if resource.Name == name {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid template type: %s", name)
+}
+
 // Template represents a template configuration
 type Template struct {
-	Name    string
-	Content string
-	Type    string
-	//Path    string
+	Name    string `yaml:"name"`
+	Content string `yaml:"-"`
+	Type    string `yaml:"type"`
+	// File is the template file, relative to the template directory
+	File string `yaml:"file"`
+	// Path is the output file, relative to the directory of the template type
+	Path string `yaml:"path"`
+	// Kinds are the app kinds the template is rendered for, empty means all
+	Kinds []string `yaml:"kinds"`
+	// When is a template expression evaluated against the app, the template is
+	// only rendered when it yields true
+	When string `yaml:"when"`
 }
 
-// Templates is a slice of Template configurations
-var Templates = []Template{
-	{
-		Name:    "deployment",
-		Content: BaseDeploymentTmpl,
-		Type:    Base.String(),
-		//Path:    Base.Path(),
-	},
-	{
-		Name:    "service",
-		Content: BaseServiceTmpl,
-		Type:    Base.String(),
-		//Path:    Base.Path(),
-	},
-	{
-		Name:    "kustomization",
-		Content: BaseKustomizationTmpl,
-		Type:    Base.String(),
-		//Path:    Base.Path(),
-	},
-	{
-		Name:    "deployment",
-		Content: DeploymentTmpl,
-		Type:    Application.String(),
-		//Path:    Application.Path(),
-	},
-	{
-		Name:    "kustomization",
-		Content: KustomizationTmpl,
-		Type:    Application.String(),
-		//Path:    Application.Path(),
-	},
-	{	Name: "namespace",
-		Content: NamespaseTmpl,
-		Type: Common.String(),
-	},
-	{   Name: "common/kustomization",
-		Content: IngressKustomizationTmpl,
-		Type: Common.String(),
-	},
-	{   Name: "common/ingress",
-		Content: IngressTmpl,
-		Type: Common.String(),
-	},
+// AppliesTo reports whether the template is rendered for apps of kind
+func (t Template) AppliesTo(kind string) bool {
+	if len(t.Kinds) == 0 {
+		return true
+	}
+	for _, k := range t.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether the template is rendered for the app
+func (t Template) Enabled(a *App) (bool, error) {
+	if !t.AppliesTo(a.Kind) {
+		return false, nil
+	}
+	if t.When == "" {
+		return true, nil
+	}
+	condition, err := template.New(t.Name + "/when").Funcs(templateFuncs).Parse(t.When)
+	if err != nil {
+		return false, fmt.Errorf("error parsing condition of template %s: %w", t.Name, err)
+	}
+	var out strings.Builder
+	if err := condition.Execute(&out, a); err != nil {
+		return false, fmt.Errorf("error evaluating condition of template %s: %w", t.Name, err)
+	}
+	return strings.TrimSpace(out.String()) == "true", nil
+}
+
+// findTemplate returns the template called name
+func findTemplate(templates []Template, name string) (Template, error) {
+	for _, tmpl := range templates {
+		if tmpl.Name == name {
+			return tmpl, nil
+		}
+	}
+	return Template{}, fmt.Errorf("no %s template found", name)
+}
+
+// templateManifest describes the templates of a template directory
+type templateManifest struct {
+	Templates []Template `yaml:"templates"`
+}
+
+// LoadTemplates reads the templates listed in dir/manifest.yaml. Template files
+// missing from dir, or the whole manifest when dir has none, come from the
+// embedded defaults.
+func LoadTemplates(dir string) ([]Template, error) {
+	embedded, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	manifestData, err := readTemplateFile(dir, embedded, manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var manifest templateManifest
+	if err := yaml.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing template manifest: %w", err)
+	}
+
+	for i, tmpl := range manifest.Templates {
+		if tmpl.File == "" {
+			return nil, fmt.Errorf("template %s has no file", tmpl.Name)
+		}
+		content, err := readTemplateFile(dir, embedded, tmpl.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading template %s: %w", tmpl.Name, err)
+		}
+		manifest.Templates[i].Content = string(content)
+	}
+	if err := ValidateTemplates(manifest.Templates); err != nil {
+		return nil, err
+	}
+	return manifest.Templates, nil
+}
+
+// readTemplateFile reads name from dir, falling back to the embedded templates
+func readTemplateFile(dir string, embedded fs.FS, name string) ([]byte, error) {
+	if dir != "" {
+		local := filepath.Join(dir, filepath.FromSlash(name))
+		exists, err := common.CheckFileExists(local)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return os.ReadFile(local)
+		}
+	}
+	return fs.ReadFile(embedded, path.Clean(name))
 }
 
 // ValidateTemplates checks if all templates are valid
-func ValidateTemplates() error {
-	for _, tmpl := range Templates {
+func ValidateTemplates(templates []Template) error {
+	for _, tmpl := range templates {
 		if tmpl.Name == "" || tmpl.Content == "" || tmpl.Type == "" {
 			return fmt.Errorf("invalid template configuration: %+v", tmpl)
 		}
+		if _, err := ParseResourceType(tmpl.Type); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,550 @@
+package application
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// Change describes one field changed in a file
+type Change struct {
+	File  string
+	Field string
+	Old   string
+	New   string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s", c.File, c.Summary())
+}
+
+// Summary describes the change without the file
+func (c Change) Summary() string {
+	old := c.Old
+	if old == "" {
+		old = "<unset>"
+	}
+	return fmt.Sprintf("%s %s -> %s", c.Field, old, c.New)
+}
+
+// UpdateOptions holds the settings to change, nil fields are left as they are
+type UpdateOptions struct {
+	Replicas *int
+	Image    *string
+	Port     *int
+	// Container receives the image, default the app's main container
+	Container string
+	// Resources set on the main container, empty quantities are left as they are
+	Resources *Resources
+	// Autoscale replaces the static replica count with an autoscaler
+	Autoscale *Autoscale
+	// App renders the files Update adds to the overlay, like hpa.yaml
+	App *App
+	// RemoveAutoscale lets Replicas replace the overlay autoscaler instead of
+	// failing while there is one
+	RemoveAutoscale bool
+	// Schedule of a cronjob
+	Schedule *string
+	// ReadinessPath and LivenessPath set the http probes of the main container
+	// in the base
+	ReadinessPath *string
+	LivenessPath  *string
+}
+
+// Update patches the manifests of an existing app in place and returns what
+// changed. Settings that already have the requested value produce no change.
+func Update(env, name string, opts UpdateOptions) ([]Change, error) {
+	overlayPath := filepath.Join(config.AppTemplatePath, env, name)
+	exists, err := common.CheckFileExists(overlayPath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("app %s does not exist in %s, use app:create", name, env)
+	}
+
+	var changes []Change
+	if opts.Replicas != nil || opts.Image != nil || opts.Resources != nil || opts.Autoscale != nil || opts.Schedule != nil {
+		overlayChanges, err := updateOverlay(overlayPath, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, overlayChanges...)
+	}
+	if opts.Port != nil {
+		portChanges, err := updatePort(name, *opts.Port)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, portChanges...)
+	}
+	if opts.ReadinessPath != nil || opts.LivenessPath != nil {
+		probeChanges, err := updateProbes(name, opts.ReadinessPath, opts.LivenessPath)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, probeChanges...)
+	}
+	return changes, nil
+}
+
+func updateOverlay(overlayPath, name string, opts UpdateOptions) ([]Change, error) {
+	workloadFile, err := FindWorkloadFile(overlayPath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := manifest.Load(workloadFile)
+	if err != nil {
+		return nil, err
+	}
+	workload := file.FindWorkload()
+	if workload == nil {
+		return nil, fmt.Errorf("no workload found in %s", workloadFile)
+	}
+
+	var changes []Change
+	if opts.Replicas != nil {
+		if manifest.Kind(workload) == "CronJob" {
+			return nil, fmt.Errorf("%s is a cronjob and has no replicas", name)
+		}
+		autoscaled, err := common.CheckFileExists(filepath.Join(overlayPath, "hpa.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		if autoscaled && !opts.RemoveAutoscale {
+			return nil, fmt.Errorf("replicas of %s are managed by the autoscaler in hpa.yaml", name)
+		}
+		if *opts.Replicas < 0 {
+			return nil, fmt.Errorf("invalid replicas %d", *opts.Replicas)
+		}
+		if err := checkReplicas(overlayPath, name, *opts.Replicas); err != nil {
+			return nil, err
+		}
+		if autoscaled {
+			removed, err := removeAutoscale(overlayPath, *opts.Replicas)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, removed...)
+		}
+		changes = setField(changes, workloadFile, "spec.replicas", manifest.Ensure(workload, "spec"), "replicas", strconv.Itoa(*opts.Replicas))
+	}
+	if opts.Image != nil {
+		if err := ValidateImage(*opts.Image); err != nil {
+			return nil, err
+		}
+		container, err := mainContainer(workload, name)
+		if opts.Container != "" {
+			container, err = manifest.Container(workload, opts.Container)
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := fmt.Sprintf("containers[%s].image", manifest.Scalar(container, "name"))
+		changes = setField(changes, workloadFile, field, container, "image", *opts.Image)
+		repositoryChanges, err := updateImageRepository(overlayPath, *opts.Image)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, repositoryChanges...)
+	}
+	if opts.Schedule != nil {
+		if manifest.Kind(workload) != "CronJob" {
+			return nil, fmt.Errorf("%s is not a cronjob and has no schedule", name)
+		}
+		changes = setField(changes, workloadFile, "spec.schedule", manifest.Ensure(workload, "spec"), "schedule", *opts.Schedule)
+	}
+	if opts.Resources != nil {
+		if err := opts.Resources.Validate(); err != nil {
+			return nil, err
+		}
+		container, err := mainContainer(workload, name)
+		if err != nil {
+			return nil, err
+		}
+		containerName := manifest.Scalar(container, "name")
+		for _, quantity := range []struct{ group, key, value string }{
+			{"requests", "cpu", opts.Resources.Requests.CPU},
+			{"requests", "memory", opts.Resources.Requests.Memory},
+			{"limits", "cpu", opts.Resources.Limits.CPU},
+			{"limits", "memory", opts.Resources.Limits.Memory},
+		} {
+			if quantity.value == "" {
+				continue
+			}
+			field := fmt.Sprintf("containers[%s].resources.%s.%s", containerName, quantity.group, quantity.key)
+			changes = setField(changes, workloadFile, field, manifest.Ensure(container, "resources", quantity.group), quantity.key, quantity.value)
+		}
+	}
+	if opts.Autoscale != nil {
+		autoscaleChanges, err := setAutoscale(overlayPath, name, workload, *opts.Autoscale, opts.App)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Delete(manifest.Get(workload, "spec"), "replicas") {
+			autoscaleChanges = append(autoscaleChanges, Change{File: workloadFile, Field: "spec.replicas", New: "<removed>"})
+		}
+		changes = append(changes, autoscaleChanges...)
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changes, file.Save()
+}
+
+// setAutoscale updates the bounds of the overlay autoscaler, rendering it from
+// the templates of app like app:create --autoscale does when the overlay has none
+func setAutoscale(overlayPath, name string, workload *yaml.Node, autoscale Autoscale, app *App) ([]Change, error) {
+	if err := autoscale.Validate(); err != nil {
+		return nil, err
+	}
+	kind := manifest.Kind(workload)
+	if kind == "CronJob" {
+		return nil, fmt.Errorf("%s is a cronjob and cannot be autoscaled", name)
+	}
+	if err := checkReplicas(overlayPath, name, autoscale.Max); err != nil {
+		return nil, err
+	}
+	container, err := mainContainer(workload, name)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Scalar(container, "resources", "requests", "cpu") == "" {
+		return nil, fmt.Errorf("%s has no cpu request, autoscaling on cpu utilization needs one", name)
+	}
+	hpaFile := filepath.Join(overlayPath, "hpa.yaml")
+	exists, err := common.CheckFileExists(hpaFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		file, err := manifest.Load(hpaFile)
+		if err != nil {
+			return nil, err
+		}
+		doc := file.Find("HorizontalPodAutoscaler")
+		if doc == nil {
+			return nil, fmt.Errorf("no autoscaler found in %s", hpaFile)
+		}
+		spec := manifest.Get(doc, "spec")
+		var changes []Change
+		changes = setField(changes, hpaFile, "spec.minReplicas", spec, "minReplicas", strconv.Itoa(autoscale.Min))
+		changes = setField(changes, hpaFile, "spec.maxReplicas", spec, "maxReplicas", strconv.Itoa(autoscale.Max))
+		if metrics := manifest.Get(spec, "metrics"); metrics != nil && len(metrics.Content) > 0 {
+			target := manifest.Get(metrics.Content[0], "resource", "target")
+			changes = setField(changes, hpaFile, "spec.metrics[cpu].averageUtilization", target, "averageUtilization", strconv.Itoa(autoscale.CPU))
+		}
+		if len(changes) == 0 {
+			return nil, nil
+		}
+		return changes, file.Save()
+	}
+
+	if app == nil {
+		return nil, fmt.Errorf("%s has no autoscaler yet, add it with an app spec and fleet apply", name)
+	}
+	tmpl, err := findTemplate(app.Templates, "hpa")
+	if err != nil {
+		return nil, err
+	}
+	app.Autoscale = autoscale
+	content, err := app.renderTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(hpaFile, content, 0644); err != nil {
+		return nil, err
+	}
+	kustomizationFile := filepath.Join(overlayPath, "kustomization.yaml")
+	if _, err := manifest.AddResource(kustomizationFile, "hpa.yaml"); err != nil {
+		return nil, err
+	}
+	return []Change{
+		{File: hpaFile, Field: "HorizontalPodAutoscaler", New: fmt.Sprintf("%d:%d:%d%%", autoscale.Min, autoscale.Max, autoscale.CPU)},
+		{File: kustomizationFile, Field: "resources", New: "hpa.yaml"},
+	}, nil
+}
+
+// removeAutoscale removes the autoscaler from the overlay, and the disruption
+// budget when at most one replica is left to protect
+func removeAutoscale(overlayPath string, replicas int) ([]Change, error) {
+	kustomizationFile := filepath.Join(overlayPath, "kustomization.yaml")
+	files := []string{"hpa.yaml"}
+	if replicas <= 1 {
+		files = append(files, "pdb.yaml")
+	}
+	var changes []Change
+	for _, name := range files {
+		path := filepath.Join(overlayPath, name)
+		file, err := manifest.Load(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kind, old := "", ""
+		if len(file.Docs) > 0 {
+			kind = manifest.Kind(file.Docs[0])
+		}
+		if hpa := file.Find("HorizontalPodAutoscaler"); hpa != nil {
+			old = fmt.Sprintf("%s:%s", manifest.Scalar(hpa, "spec", "minReplicas"), manifest.Scalar(hpa, "spec", "maxReplicas"))
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		changes = append(changes, Change{File: path, Field: kind, Old: old, New: "<removed>"})
+		removed, err := manifest.RemoveResource(kustomizationFile, name)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			changes = append(changes, Change{File: kustomizationFile, Field: "resources", Old: name, New: "<removed>"})
+		}
+	}
+	return changes, nil
+}
+
+// checkReplicas refuses more than one replica when the overlay mounts a
+// ReadWriteOnce volume
+func checkReplicas(overlayPath, name string, replicas int) error {
+	if replicas <= 1 {
+		return nil
+	}
+	claims, err := readWriteOnceClaims(overlayPath)
+	if err != nil {
+		return err
+	}
+	if len(claims) > 0 {
+		return fmt.Errorf("%s mounts %s volume %s, it cannot run more than one replica", name, ReadWriteOnce, claims[0])
+	}
+	return nil
+}
+
+// updatePort moves the app to a new container port. The port lives in the
+// base, so every environment of the app picks it up.
+func updatePort(name string, port int) ([]Change, error) {
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+	appBase := filepath.Join(basePath, name)
+	workloadFile, err := FindWorkloadFile(appBase)
+	if err != nil {
+		return nil, err
+	}
+	workloadManifest, err := manifest.Load(workloadFile)
+	if err != nil {
+		return nil, err
+	}
+	workload := workloadManifest.FindWorkload()
+	if workload == nil {
+		return nil, fmt.Errorf("no workload found in %s", workloadFile)
+	}
+	container, err := mainContainer(workload, name)
+	if err != nil {
+		return nil, err
+	}
+	containerPort := manifest.Get(container, "ports")
+	if containerPort == nil || len(containerPort.Content) == 0 {
+		return nil, fmt.Errorf("%s does not expose a port", name)
+	}
+	oldPort := manifest.Scalar(containerPort.Content[0], "containerPort")
+	newPort := strconv.Itoa(port)
+	if oldPort != newPort && storage.IsPortUsed(port) && storage.GetPort(name) != port {
+		return nil, fmt.Errorf("port %d is already in use", port)
+	}
+
+	var changes []Change
+	field := fmt.Sprintf("containers[%s].ports[0].containerPort", manifest.Scalar(container, "name"))
+	changes = setField(changes, workloadFile, field, containerPort.Content[0], "containerPort", newPort)
+	changes = setProbePorts(changes, workloadFile, container, oldPort, newPort)
+	if len(changes) > 0 {
+		if err := workloadManifest.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	// overlays patch in the default probes of their environment
+	overlays, err := filepath.Glob(filepath.Join(config.AppTemplatePath, "*", name))
+	if err != nil {
+		return nil, err
+	}
+	for _, overlayPath := range overlays {
+		if overlayPath == appBase {
+			continue
+		}
+		overlayFile, err := FindWorkloadFile(overlayPath)
+		if err != nil {
+			continue
+		}
+		overlay, err := manifest.Load(overlayFile)
+		if err != nil {
+			return nil, err
+		}
+		overlayWorkload := overlay.FindWorkload()
+		if overlayWorkload == nil {
+			continue
+		}
+		overlayContainer, err := mainContainer(overlayWorkload, name)
+		if err != nil {
+			continue
+		}
+		before := len(changes)
+		changes = setProbePorts(changes, overlayFile, overlayContainer, oldPort, newPort)
+		if len(changes) > before {
+			if err := overlay.Save(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	serviceFile := filepath.Join(appBase, "service.yaml")
+	exists, err := common.CheckFileExists(serviceFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		serviceManifest, err := manifest.Load(serviceFile)
+		if err != nil {
+			return nil, err
+		}
+		serviceChanged := false
+		if service := serviceManifest.Find("Service"); service != nil {
+			if ports := manifest.Get(service, "spec", "ports"); ports != nil && len(ports.Content) > 0 {
+				before := len(changes)
+				changes = setField(changes, serviceFile, "spec.ports[0].targetPort", ports.Content[0], "targetPort", newPort)
+				serviceChanged = len(changes) > before
+			}
+		}
+		if serviceChanged {
+			if err := serviceManifest.Save(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if oldPort != newPort || storage.GetPort(name) != port {
+		before := storage.GetPort(name)
+		if err := storage.UpdatePort(name, port); err != nil {
+			return nil, err
+		}
+		if before != port {
+			changes = append(changes, Change{File: "ports.txt", Field: name, Old: portString(before), New: newPort})
+		}
+	}
+
+	return changes, nil
+}
+
+// updateImageRepository keeps the repository scanned by the image automation
+// of the overlay in line with the image
+func updateImageRepository(overlayPath, image string) ([]Change, error) {
+	automationFile := filepath.Join(overlayPath, "image-automation.yaml")
+	file, err := manifest.Load(automationFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc := file.Find("ImageRepository")
+	if doc == nil {
+		return nil, nil
+	}
+	repository, _ := splitImage(image)
+	changes := setField(nil, automationFile, "ImageRepository.spec.image", manifest.Ensure(doc, "spec"), "image", repository)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changes, file.Save()
+}
+
+// updateProbes sets the http paths of the readiness and liveness probes of the
+// main container in the base, adding the probes on the container port when
+// they are missing
+func updateProbes(name string, readinessPath, livenessPath *string) ([]Change, error) {
+	workloadFile, err := FindWorkloadFile(filepath.Join(basePath, name))
+	if err != nil {
+		return nil, err
+	}
+	file, err := manifest.Load(workloadFile)
+	if err != nil {
+		return nil, err
+	}
+	workload := file.FindWorkload()
+	if workload == nil {
+		return nil, fmt.Errorf("no workload found in %s", workloadFile)
+	}
+	container, err := mainContainer(workload, name)
+	if err != nil {
+		return nil, err
+	}
+	ports := manifest.Get(container, "ports")
+	if ports == nil || len(ports.Content) == 0 {
+		return nil, fmt.Errorf("%s does not expose a port to probe", name)
+	}
+	port := manifest.Scalar(ports.Content[0], "containerPort")
+
+	var changes []Change
+	for _, probe := range []struct {
+		key  string
+		path *string
+	}{{"readinessProbe", readinessPath}, {"livenessProbe", livenessPath}} {
+		if probe.path == nil {
+			continue
+		}
+		httpGet := manifest.Ensure(container, probe.key, "httpGet")
+		changes = setField(changes, workloadFile, probe.key+".httpGet.path", httpGet, "path", *probe.path)
+		if manifest.Scalar(httpGet, "port") == "" {
+			changes = setField(changes, workloadFile, probe.key+".httpGet.port", httpGet, "port", port)
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changes, file.Save()
+}
+
+// setProbePorts moves the http probes of container from oldPort to newPort
+func setProbePorts(changes []Change, file string, container *yaml.Node, oldPort, newPort string) []Change {
+	for _, probe := range []string{"readinessProbe", "livenessProbe", "startupProbe"} {
+		probePort := manifest.Get(container, probe, "httpGet")
+		if manifest.Scalar(probePort, "port") != oldPort {
+			continue
+		}
+		changes = setField(changes, file, probe+".httpGet.port", probePort, "port", newPort)
+	}
+	return changes
+}
+
+// mainContainer returns the container named after the app, or the first one
+func mainContainer(workload *yaml.Node, name string) (*yaml.Node, error) {
+	if container, err := manifest.Container(workload, name); err == nil {
+		return container, nil
+	}
+	return manifest.Container(workload, "")
+}
+
+// setField sets key in node to value and records the change when it differs
+func setField(changes []Change, file, field string, node *yaml.Node, key, value string) []Change {
+	old := manifest.Scalar(node, key)
+	if old == value {
+		return changes
+	}
+	manifest.SetScalar(node, key, value)
+	return append(changes, Change{File: file, Field: field, Old: old, New: value})
+}
+
+func portString(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(port)
+}
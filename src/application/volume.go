@@ -0,0 +1,239 @@
+package application
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"gopkg.in/yaml.v3"
+)
+
+// Volume access modes
+const (
+	ReadWriteOnce = "ReadWriteOnce"
+	ReadWriteMany = "ReadWriteMany"
+	ReadOnlyMany  = "ReadOnlyMany"
+)
+
+// VolumeOptions describes a persistent volume attached by app:volume add
+type VolumeOptions struct {
+	// Name of the volume, the claim is called <app>-<name>
+	Name         string
+	Size         string
+	MountPath    string
+	StorageClass string
+	AccessMode   string
+	Container    string
+}
+
+type persistentVolumeClaim struct {
+	ApiVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name   string            `yaml:"name"`
+		Labels map[string]string `yaml:"labels"`
+	} `yaml:"metadata"`
+	Spec struct {
+		AccessModes      []string `yaml:"accessModes"`
+		StorageClassName string   `yaml:"storageClassName,omitempty"`
+		Resources        struct {
+			Requests struct {
+				Storage string `yaml:"storage"`
+			} `yaml:"requests"`
+		} `yaml:"resources"`
+	} `yaml:"spec"`
+}
+
+type claimVolume struct {
+	Name                  string `yaml:"name"`
+	PersistentVolumeClaim struct {
+		ClaimName string `yaml:"claimName"`
+	} `yaml:"persistentVolumeClaim"`
+}
+
+// AddVolume renders a PersistentVolumeClaim into the app overlay and mounts it
+// into the workload. ReadWriteOnce volumes can only be mounted by one node, so
+// they are refused for apps that may run more than one replica. Nothing is
+// changed when a step fails.
+func AddVolume(env, name string, opts VolumeOptions) ([]Change, error) {
+	undo := &rollback{}
+	changes, err := addVolume(env, name, opts, undo)
+	if err != nil {
+		undo.restore()
+		return nil, err
+	}
+	return changes, nil
+}
+
+func addVolume(env, name string, opts VolumeOptions, undo *rollback) ([]Change, error) {
+	if opts.Name == "" {
+		opts.Name = "data"
+	}
+	if opts.AccessMode == "" {
+		opts.AccessMode = ReadWriteOnce
+	}
+	if !containerNamePattern.MatchString(opts.Name) {
+		return nil, fmt.Errorf("invalid volume name %q", opts.Name)
+	}
+	if !quantityPattern.MatchString(opts.Size) {
+		return nil, fmt.Errorf("invalid volume size %q", opts.Size)
+	}
+	if !path.IsAbs(opts.MountPath) {
+		return nil, fmt.Errorf("mount path %q is not absolute", opts.MountPath)
+	}
+	switch opts.AccessMode {
+	case ReadWriteOnce, ReadWriteMany, ReadOnlyMany:
+	default:
+		return nil, fmt.Errorf("invalid access mode %s, use %s|%s|%s", opts.AccessMode, ReadWriteOnce, ReadWriteMany, ReadOnlyMany)
+	}
+
+	file, workload, err := loadOverlayWorkload(env, name)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Kind(workload) == "StatefulSet" {
+		return nil, fmt.Errorf("%s is a statefulset, its replicas get their own volume from volumeClaimTemplates", name)
+	}
+	overlayPath := filepath.Join(config.AppTemplatePath, env, name)
+	if opts.AccessMode == ReadWriteOnce {
+		replicas, err := maxReplicas(overlayPath, workload)
+		if err != nil {
+			return nil, err
+		}
+		if replicas > 1 {
+			return nil, fmt.Errorf("%s can run %d replicas, a %s volume can only be attached to one node, use --access-mode %s", name, replicas, ReadWriteOnce, ReadWriteMany)
+		}
+	}
+
+	claimName := name + "-" + opts.Name
+	claimFile := "pvc-" + opts.Name + ".yaml"
+	claimPath := filepath.Join(overlayPath, claimFile)
+	exists, err := common.CheckFileExists(claimPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("volume %s already exists in %s", opts.Name, claimPath)
+	}
+	var claim persistentVolumeClaim
+	claim.ApiVersion = "v1"
+	claim.Kind = "PersistentVolumeClaim"
+	claim.Metadata.Name = claimName
+	claim.Metadata.Labels = map[string]string{"app": name}
+	claim.Spec.AccessModes = []string{opts.AccessMode}
+	claim.Spec.StorageClassName = opts.StorageClass
+	claim.Spec.Resources.Requests.Storage = opts.Size
+	claimManifest := &manifest.File{Path: claimPath}
+	node, err := manifest.FromValue(claim)
+	if err != nil {
+		return nil, err
+	}
+	claimManifest.Docs = append(claimManifest.Docs, node)
+
+	container, err := mainContainer(workload, name)
+	if opts.Container != "" {
+		container, err = manifest.Container(workload, opts.Container)
+	}
+	if err != nil {
+		return nil, err
+	}
+	containerName := manifest.Scalar(container, "name")
+	if mounts := manifest.Get(container, "volumeMounts"); mounts != nil {
+		for _, mount := range mounts.Content {
+			if manifest.Scalar(mount, "mountPath") == opts.MountPath {
+				return nil, fmt.Errorf("%s is already mounted at %s in container %s", manifest.Scalar(mount, "name"), opts.MountPath, containerName)
+			}
+		}
+	}
+
+	var volume claimVolume
+	volume.Name = opts.Name
+	volume.PersistentVolumeClaim.ClaimName = claimName
+	added, err := addListItem(manifest.PodSpec(workload), "volumes", "name", opts.Name, volume)
+	if err != nil {
+		return nil, err
+	}
+	if !added {
+		return nil, fmt.Errorf("volume %s already exists in %s", opts.Name, file.Path)
+	}
+	if _, err := setVolumeMount(container, volumeMount{Name: opts.Name, MountPath: opts.MountPath}); err != nil {
+		return nil, err
+	}
+
+	kustomizationFile := filepath.Join(overlayPath, "kustomization.yaml")
+	if err := undo.track(claimPath, kustomizationFile); err != nil {
+		return nil, err
+	}
+	if err := claimManifest.Save(); err != nil {
+		return nil, err
+	}
+	if _, err := manifest.AddResource(kustomizationFile, claimFile); err != nil {
+		return nil, err
+	}
+	if err := saveOverlayWorkload(file, env, name, undo); err != nil {
+		return nil, err
+	}
+	return []Change{
+		{File: claimPath, Field: "PersistentVolumeClaim", New: fmt.Sprintf("%s %s %s", claimName, opts.Size, opts.AccessMode)},
+		{File: kustomizationFile, Field: "resources", New: claimFile},
+		{File: file.Path, Field: fmt.Sprintf("volumes[%s]", opts.Name), New: "claim " + claimName},
+		{File: file.Path, Field: fmt.Sprintf("containers[%s].volumeMounts[%s]", containerName, opts.Name), New: opts.MountPath},
+	}, nil
+}
+
+// maxReplicas returns the highest replica count the app can run with, the
+// autoscaler bound when the overlay has one
+func maxReplicas(overlayPath string, workload *yaml.Node) (int, error) {
+	hpaFile := filepath.Join(overlayPath, "hpa.yaml")
+	exists, err := common.CheckFileExists(hpaFile)
+	if err != nil {
+		return 0, err
+	}
+	replicas := manifest.Scalar(workload, "spec", "replicas")
+	if exists {
+		hpa, err := manifest.Load(hpaFile)
+		if err != nil {
+			return 0, err
+		}
+		if doc := hpa.Find("HorizontalPodAutoscaler"); doc != nil {
+			replicas = manifest.Scalar(doc, "spec", "maxReplicas")
+		}
+	}
+	if n, err := strconv.Atoi(replicas); err == nil {
+		return n, nil
+	}
+	// the base sets no replicas, kubernetes defaults to one
+	return 1, nil
+}
+
+// readWriteOnceClaims returns the ReadWriteOnce claims rendered into the overlay
+func readWriteOnceClaims(overlayPath string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(overlayPath, "pvc-*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var claims []string
+	for _, claimFile := range files {
+		file, err := manifest.Load(claimFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range file.Docs {
+			modes := manifest.Get(doc, "spec", "accessModes")
+			if manifest.Kind(doc) != "PersistentVolumeClaim" || modes == nil {
+				continue
+			}
+			for _, mode := range modes.Content {
+				if mode.Value == ReadWriteOnce {
+					claims = append(claims, manifest.Scalar(doc, "metadata", "name"))
+					break
+				}
+			}
+		}
+	}
+	return claims, nil
+}
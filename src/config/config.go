@@ -2,9 +2,16 @@ package config
 
 const (
 	ClusterName      = "<cluster_name>"
-	BaseTemplatePath = "base"
+	BaseTemplatePath = "apps/base"
 	ImageHost        = "ghcr.io/africhild"
 	UrlSuffix        = "stage.example.com"
+
+	// sealed-secrets controller as installed by infrastructure/controllers/sealed-secrets.yaml
+	SealedSecretsController = "sealed-secrets-controller"
+	SealedSecretsNamespace  = "flux-system"
 )
 
 var AppTemplatePath string = "apps"
+var ClusterPath string = "clusters"
+var CertPath string = "certs"
+var TemplatePath string = "templates"
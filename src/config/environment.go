@@ -0,0 +1,194 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FleetConfigFile holds the per environment settings of the repository
+var FleetConfigFile string = "fleet.yaml"
+
+// Secret backends
+const (
+	SealedSecretsBackend = "sealedsecrets"
+	SopsAgeBackend       = "sops-age"
+)
+
+// Environment holds the settings of a single environment
+type Environment struct {
+	Name string `yaml:"name"`
+	// Domain is the suffix of the environment's ingress hosts, default UrlSuffix
+	Domain string `yaml:"domain,omitempty"`
+	// SecretBackend is sealedsecrets (default) or sops-age
+	SecretBackend string `yaml:"secretBackend,omitempty"`
+	// AgeRecipients are the age public keys secrets are encrypted for with sops-age
+	AgeRecipients []string `yaml:"ageRecipients,omitempty"`
+	// SopsSecretName is the secret holding the age private key in flux-system
+	SopsSecretName string `yaml:"sopsSecretName,omitempty"`
+	// SealingCert is the sealed-secrets certificate, default certs/<name>.pem.
+	// Relative paths are resolved against the repository root.
+	SealingCert string `yaml:"sealingCert,omitempty"`
+	// GitBranch is the branch Flux syncs the environment from, default main
+	GitBranch string `yaml:"gitBranch,omitempty"`
+	// KubeContext is the kubeconfig context of the environment's cluster
+	KubeContext string `yaml:"kubeContext,omitempty"`
+	// AppDefaults apply to apps created in the environment unless overridden
+	AppDefaults AppDefaults `yaml:"appDefaults,omitempty"`
+	// Lint sets the severity (error|warning|off) of lint rules by rule name
+	Lint map[string]string `yaml:"lint,omitempty"`
+	// Namespace holds the labels, quota and limit range of the namespace
+	Namespace NamespaceSettings `yaml:"namespace,omitempty"`
+}
+
+// NamespaceSettings are rendered into the namespace manifests of an
+// environment by env:create and env:update
+type NamespaceSettings struct {
+	// Labels of the namespace, like toolkit.fluxcd.io/tenant
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Quota is the hard limits of the ResourceQuota, like requests.cpu or pods
+	Quota map[string]string `yaml:"quota,omitempty"`
+	// LimitRange holds the container defaults and bounds of the LimitRange
+	LimitRange LimitRange `yaml:"limitRange,omitempty"`
+}
+
+// IsSet reports whether any namespace setting is set
+func (n NamespaceSettings) IsSet() bool {
+	return len(n.Labels) > 0 || len(n.Quota) > 0 || n.LimitRange.IsSet()
+}
+
+// LimitRange holds quantities by resource name, like cpu or memory
+type LimitRange struct {
+	Default        map[string]string `yaml:"default,omitempty"`
+	DefaultRequest map[string]string `yaml:"defaultRequest,omitempty"`
+	Max            map[string]string `yaml:"max,omitempty"`
+	Min            map[string]string `yaml:"min,omitempty"`
+}
+
+// IsSet reports whether any bound or default is set
+func (l LimitRange) IsSet() bool {
+	return len(l.Default) > 0 || len(l.DefaultRequest) > 0 || len(l.Max) > 0 || len(l.Min) > 0
+}
+
+// AppDefaults are the probe, resource and security settings of new apps
+type AppDefaults struct {
+	ReadinessPath          string `yaml:"readinessPath,omitempty"`
+	LivenessPath           string `yaml:"livenessPath,omitempty"`
+	CPURequest             string `yaml:"cpuRequest,omitempty"`
+	MemoryRequest          string `yaml:"memoryRequest,omitempty"`
+	CPULimit               string `yaml:"cpuLimit,omitempty"`
+	MemoryLimit            string `yaml:"memoryLimit,omitempty"`
+	RunAsNonRoot           bool   `yaml:"runAsNonRoot,omitempty"`
+	ReadOnlyRootFilesystem bool   `yaml:"readOnlyRootFilesystem,omitempty"`
+}
+
+// FleetConfig is the content of FleetConfigFile
+type FleetConfig struct {
+	Environments []Environment `yaml:"environments"`
+	// LintRules are checked by fleet lint next to the built-in rules
+	LintRules []LintRule `yaml:"lintRules,omitempty"`
+}
+
+// LintRule is a custom lint rule
+type LintRule struct {
+	Name string `yaml:"name"`
+	// Kinds limits the rule to objects of these kinds
+	Kinds []string `yaml:"kinds,omitempty"`
+	// Violation is a template expression evaluated against the object, the
+	// object violates the rule when it yields true
+	Violation string `yaml:"violation"`
+	Message   string `yaml:"message"`
+	// Severity is error (default), warning or off
+	Severity string `yaml:"severity,omitempty"`
+}
+
+// LoadFleetConfig reads FleetConfigFile at the root of the repository, a
+// missing file yields an empty config
+func LoadFleetConfig() (*FleetConfig, error) {
+	fleetConfig := &FleetConfig{}
+	path := filepath.Join(RepositoryRoot(), FleetConfigFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fleetConfig, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, fleetConfig); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return fleetConfig, nil
+}
+
+// RepositoryRoot returns the closest directory at or above the working
+// directory holding FleetConfigFile or .git, relative to the working directory.
+// It falls back to the working directory.
+func RepositoryRoot() string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	for dir := cwd; ; dir = filepath.Dir(dir) {
+		for _, marker := range []string{FleetConfigFile, ".git"} {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				if rel, err := filepath.Rel(cwd, dir); err == nil {
+					return rel
+				}
+				return dir
+			}
+		}
+		if filepath.Dir(dir) == dir {
+			return "."
+		}
+	}
+}
+
+// Environment returns the settings of env with defaults applied
+func (c *FleetConfig) Environment(env string) Environment {
+	environment := Environment{Name: env}
+	for _, e := range c.Environments {
+		if e.Name == env {
+			environment = e
+			break
+		}
+	}
+	if environment.SecretBackend == "" {
+		environment.SecretBackend = SealedSecretsBackend
+	}
+	if environment.SopsSecretName == "" {
+		environment.SopsSecretName = "sops-age"
+	}
+	if environment.GitBranch == "" {
+		environment.GitBranch = "main"
+	}
+	if environment.Domain == "" {
+		environment.Domain = UrlSuffix
+	}
+	if environment.SealingCert == "" {
+		environment.SealingCert = filepath.Join(CertPath, env+".pem")
+	}
+	if !filepath.IsAbs(environment.SealingCert) {
+		environment.SealingCert = filepath.Join(RepositoryRoot(), environment.SealingCert)
+	}
+	return environment
+}
+
+// Host returns the ingress host of a subdomain, @ is the domain itself
+func (e Environment) Host(subdomain string) string {
+	if subdomain == "@" {
+		return e.Domain
+	}
+	return fmt.Sprintf("%s.%s", subdomain, e.Domain)
+}
+
+// Subdomain is the inverse of Host, it returns false for hosts outside the domain
+func (e Environment) Subdomain(host string) (string, bool) {
+	if host == e.Domain {
+		return "@", true
+	}
+	subdomain := strings.TrimSuffix(host, "."+e.Domain)
+	return subdomain, subdomain != host
+}
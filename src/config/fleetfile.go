@@ -0,0 +1,216 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// AddEnvironment appends the settings of a new environment to FleetConfigFile.
+// The entry is inserted as text so the rest of the file and its comments stay
+// as they are.
+func AddEnvironment(environment Environment) error {
+	data, err := os.ReadFile(FleetConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fleetConfig := &FleetConfig{}
+	if err := yaml.Unmarshal(data, fleetConfig); err != nil {
+		return fmt.Errorf("error parsing %s: %w", FleetConfigFile, err)
+	}
+	for _, e := range fleetConfig.Environments {
+		if e.Name == environment.Name {
+			return fmt.Errorf("environment %s is already in %s", environment.Name, FleetConfigFile)
+		}
+	}
+	entry, err := yaml.Marshal([]Environment{environment})
+	if err != nil {
+		return err
+	}
+
+	key, list, err := environmentsNode(data)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	var at int
+	var indent string
+	switch {
+	case key == nil:
+		// no environments yet, the list goes at the end of the file
+		if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+			data = append(data, '\n')
+		}
+		data = append(data, "environments:\n"...)
+		data = append(data, indentLines(string(entry), "  ")...)
+		return os.WriteFile(FleetConfigFile, data, 0644)
+	case list.Kind == yaml3.ScalarNode && list.Tag == "!!null":
+		at, indent = key.Line, "  "
+	case list.Kind == yaml3.SequenceNode && list.Style&yaml3.FlowStyle == 0 && len(list.Content) > 0:
+		indent = strings.Repeat(" ", list.Column-1)
+		at = itemEnd(lines, list.Content[len(list.Content)-1], list.Column)
+	default:
+		return fmt.Errorf("environments in %s is not a block list, add %s by hand", FleetConfigFile, environment.Name)
+	}
+	inserted := strings.Split(strings.TrimSuffix(indentLines(string(entry), indent), "\n"), "\n")
+	lines = append(lines[:at], append(inserted, lines[at:]...)...)
+	return os.WriteFile(FleetConfigFile, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// RemoveEnvironment removes the entry of env from FleetConfigFile, it reports
+// false when the file has none. Like AddEnvironment it edits the text.
+func RemoveEnvironment(env string) (bool, error) {
+	data, err := os.ReadFile(FleetConfigFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, list, err := environmentsNode(data)
+	if err != nil || list == nil || list.Kind != yaml3.SequenceNode {
+		return false, err
+	}
+	for _, item := range list.Content {
+		if nameOf(item) != env {
+			continue
+		}
+		if list.Style&yaml3.FlowStyle != 0 {
+			return false, fmt.Errorf("environments in %s is not a block list, remove %s by hand", FleetConfigFile, env)
+		}
+		lines := strings.Split(string(data), "\n")
+		start := item.Line - 1
+		for start > 0 && !strings.HasPrefix(strings.TrimSpace(lines[start]), "-") {
+			start--
+		}
+		lines = append(lines[:start], lines[itemEnd(lines, item, list.Column):]...)
+		return true, os.WriteFile(FleetConfigFile, []byte(strings.Join(lines, "\n")), 0644)
+	}
+	return false, nil
+}
+
+// SetEnvironmentField sets key in the entry of env in FleetConfigFile to
+// value, a nil value removes the key. Only the lines of the field change, the
+// entry is appended when the file has none for env.
+func SetEnvironmentField(env, key string, value interface{}) error {
+	data, err := os.ReadFile(FleetConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, list, err := environmentsNode(data)
+	if err != nil {
+		return err
+	}
+	var item *yaml3.Node
+	if list != nil && list.Kind == yaml3.SequenceNode {
+		for _, entry := range list.Content {
+			if nameOf(entry) == env {
+				item = entry
+			}
+		}
+	}
+	if item == nil {
+		if value == nil {
+			return nil
+		}
+		if err := AddEnvironment(Environment{Name: env}); err != nil {
+			return err
+		}
+		return SetEnvironmentField(env, key, value)
+	}
+	if list.Style&yaml3.FlowStyle != 0 || item.Kind != yaml3.MappingNode || item.Style&yaml3.FlowStyle != 0 {
+		return fmt.Errorf("environment %s in %s is not a block mapping, set %s by hand", env, FleetConfigFile, key)
+	}
+
+	var field []string
+	if value != nil {
+		out, err := yaml.Marshal(map[string]interface{}{key: value})
+		if err != nil {
+			return err
+		}
+		indent := strings.Repeat(" ", item.Content[0].Column-1)
+		field = strings.Split(strings.TrimSuffix(indentLines(string(out), indent), "\n"), "\n")
+	}
+	lines := strings.Split(string(data), "\n")
+	start, end := -1, -1
+	for i := 0; i+1 < len(item.Content); i += 2 {
+		if item.Content[i].Value == key {
+			start = item.Content[i].Line - 1
+			end = itemEnd(lines, item.Content[i+1], item.Content[i].Column)
+		}
+	}
+	if start < 0 {
+		start = itemEnd(lines, item, list.Column)
+		end = start
+	}
+	lines = append(lines[:start], append(field, lines[end:]...)...)
+	return os.WriteFile(FleetConfigFile, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// environmentsNode returns the environments key of the fleet config and its
+// value, both nil when the key is missing
+func environmentsNode(data []byte) (*yaml3.Node, *yaml3.Node, error) {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %w", FleetConfigFile, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml3.MappingNode {
+		return nil, nil, nil
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "environments" {
+			return root.Content[i], root.Content[i+1], nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// itemEnd returns the index of the first line after a list item or a field.
+// It runs to its last node and the lines indented past column that follow it,
+// like comments or the rest of a block scalar.
+func itemEnd(lines []string, item *yaml3.Node, column int) int {
+	end := lastLine(item)
+	for end < len(lines) {
+		line := lines[end]
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || len(line)-len(trimmed) < column {
+			break
+		}
+		end++
+	}
+	return end
+}
+
+// lastLine returns the line of the last node below node
+func lastLine(node *yaml3.Node) int {
+	line := node.Line
+	for _, child := range node.Content {
+		if l := lastLine(child); l > line {
+			line = l
+		}
+	}
+	return line
+}
+
+func nameOf(item *yaml3.Node) string {
+	for i := 0; i+1 < len(item.Content); i += 2 {
+		if item.Content[i].Value == "name" {
+			return item.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+func indentLines(text, indent string) string {
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line != "" {
+			out.WriteString(indent + line)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,26 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Commit stages files and commits them with message, other staged changes
+// are left out of the commit
+func Commit(message string, files ...string) error {
+	if err := run(append([]string{"add", "--"}, files...)...); err != nil {
+		return err
+	}
+	return run(append([]string{"commit", "-m", message, "--"}, files...)...)
+}
+
+func run(args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return nil
+}
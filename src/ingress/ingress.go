@@ -5,13 +5,37 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/africhild/fleet-infra/src/common"
 	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
 	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
+// ingressPathSpec and ingressRuleSpec mirror the rules of IngressYAML for node edits
+type ingressPathSpec struct {
+	Path     string `yaml:"path"`
+	PathType string `yaml:"pathType"`
+	Backend  struct {
+		Service struct {
+			Name string `yaml:"name"`
+			Port struct {
+				Number int `yaml:"number"`
+			} `yaml:"port"`
+		} `yaml:"service"`
+	} `yaml:"backend"`
+}
+
+type ingressRuleSpec struct {
+	Host string `yaml:"host"`
+	Http struct {
+		Paths []ingressPathSpec `yaml:"paths"`
+	} `yaml:"http"`
+}
+
 type IngressYAML struct {
 	ApiVersion string `yaml:"apiVersion"`
 	Kind       string `yaml:"kind"`
@@ -45,12 +69,11 @@ func ManageIngressRule(env, serviceName, subdomain string, add bool) error {
 	ingressPath := filepath.Join(config.AppTemplatePath, env, "common", "ingress.yaml")
 	// Check if the ingress file exists
 	fileStatus, err := common.CheckFileExists(ingressPath)
-	var host string
-	if subdomain == "@" {
-		host = config.UrlSuffix
-	} else {
-		host = fmt.Sprintf("%s.%s", subdomain, config.UrlSuffix)
+	fleetConfig, configErr := config.LoadFleetConfig()
+	if configErr != nil {
+		return configErr
 	}
+	host := fleetConfig.Environment(env).Host(subdomain)
 	if err != nil {
 		fmt.Println("Error checking file:", err)
 		os.Exit(1)
@@ -156,6 +179,9 @@ func ManageIngressRule(env, serviceName, subdomain string, add bool) error {
 		// Remove the rule
 		ingress.Spec.Rules = append(ingress.Spec.Rules[:ruleIndex], ingress.Spec.Rules[ruleIndex+1:]...)
 		fmt.Printf("Removed rule for %s\n", serviceName)
+		if len(ingress.Spec.Rules) == 0 {
+			return removeIngress(ingressPath)
+		}
 	}
 
 	// Marshal the updated struct back to YAML
@@ -172,3 +198,147 @@ func ManageIngressRule(env, serviceName, subdomain string, add bool) error {
 
 	return nil
 }
+
+// Rule routes a host and path of env's ingress to a service
+type Rule struct {
+	Host    string `json:"host" yaml:"host"`
+	Path    string `json:"path" yaml:"path"`
+	Service string `json:"service" yaml:"service"`
+	Port    int    `json:"port" yaml:"port"`
+}
+
+// Rules returns the rules of env's ingress, one per path
+func Rules(env string) ([]Rule, error) {
+	ingressPath := filepath.Join(config.AppTemplatePath, env, "common", "ingress.yaml")
+	exists, err := common.CheckFileExists(ingressPath)
+	if err != nil || !exists {
+		return nil, err
+	}
+	file, err := manifest.Load(ingressPath)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for _, doc := range file.Docs {
+		if manifest.Kind(doc) != "Ingress" {
+			continue
+		}
+		ruleList := manifest.Get(doc, "spec", "rules")
+		if ruleList == nil {
+			continue
+		}
+		for _, rule := range ruleList.Content {
+			paths := manifest.Get(rule, "http", "paths")
+			if paths == nil {
+				continue
+			}
+			for _, path := range paths.Content {
+				port, _ := strconv.Atoi(manifest.Scalar(path, "backend", "service", "port", "number"))
+				rules = append(rules, Rule{
+					Host:    manifest.Scalar(rule, "host"),
+					Path:    manifest.Scalar(path, "path"),
+					Service: manifest.Scalar(path, "backend", "service", "name"),
+					Port:    port,
+				})
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Hosts returns the hosts of the rules routing to serviceName in env's ingress
+func Hosts(env, serviceName string) ([]string, error) {
+	rules, err := Rules(env)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, rule := range rules {
+		if rule.Service != serviceName || (len(hosts) > 0 && hosts[len(hosts)-1] == rule.Host) {
+			continue
+		}
+		hosts = append(hosts, rule.Host)
+	}
+	return hosts, nil
+}
+
+// AddRule routes host to serviceName in env's ingress, keeping the rest of the
+// file as it is. It reports false when a rule for host already exists.
+func AddRule(env, host, serviceName string, port int) (bool, error) {
+	ingressPath := filepath.Join(config.AppTemplatePath, env, "common", "ingress.yaml")
+	file, err := manifest.Load(ingressPath)
+	if err != nil {
+		return false, err
+	}
+	doc := file.Find("Ingress")
+	if doc == nil {
+		return false, fmt.Errorf("no ingress found in %s", ingressPath)
+	}
+	rules := manifest.Get(doc, "spec", "rules")
+	if rules == nil || rules.Kind != yamlv3.SequenceNode {
+		rules = &yamlv3.Node{Kind: yamlv3.SequenceNode, Tag: "!!seq"}
+		manifest.Set(manifest.Ensure(doc, "spec"), "rules", rules)
+	}
+	for _, rule := range rules.Content {
+		if manifest.Scalar(rule, "host") == host {
+			return false, nil
+		}
+	}
+	// a flow style empty list would keep the new rule on one line
+	rules.Style = 0
+	var rule ingressRuleSpec
+	rule.Host = host
+	rule.Http.Paths = []ingressPathSpec{{Path: "/", PathType: "Prefix"}}
+	rule.Http.Paths[0].Backend.Service.Name = serviceName
+	rule.Http.Paths[0].Backend.Service.Port.Number = port
+	node, err := manifest.FromValue(rule)
+	if err != nil {
+		return false, err
+	}
+	rules.Content = append(rules.Content, node)
+	return true, file.Save()
+}
+
+// RemoveRule drops the rule for host from env's ingress, reporting false when
+// there is none. The ingress goes with its last rule.
+func RemoveRule(env, host string) (bool, error) {
+	ingressPath := filepath.Join(config.AppTemplatePath, env, "common", "ingress.yaml")
+	file, err := manifest.Load(ingressPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, doc := range file.Docs {
+		rules := manifest.Get(doc, "spec", "rules")
+		if manifest.Kind(doc) != "Ingress" || rules == nil {
+			continue
+		}
+		for i, rule := range rules.Content {
+			if manifest.Scalar(rule, "host") == host {
+				rules.Content = append(rules.Content[:i], rules.Content[i+1:]...)
+				if len(rules.Content) == 0 && manifest.Get(doc, "spec", "defaultBackend") == nil {
+					return true, removeIngress(ingressPath)
+				}
+				return true, file.Save()
+			}
+		}
+	}
+	return false, nil
+}
+
+// removeIngress deletes an ingress without rules and its entry in the
+// kustomization next to it, the API server would reject it
+func removeIngress(ingressPath string) error {
+	if err := os.Remove(ingressPath); err != nil {
+		return err
+	}
+	kustomizationFile := filepath.Join(filepath.Dir(ingressPath), "kustomization.yaml")
+	exists, err := common.CheckFileExists(kustomizationFile)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = manifest.RemoveResource(kustomizationFile, filepath.Base(ingressPath))
+	return err
+}
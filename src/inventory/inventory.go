@@ -0,0 +1,250 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/africhild/fleet-infra/src/application"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/ingress"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
+	"github.com/africhild/fleet-infra/src/secret"
+	"github.com/africhild/fleet-infra/src/storage"
+)
+
+// App is an application with a base
+type App struct {
+	Name string `json:"name" yaml:"name"`
+	// Workload is the kind of the base workload, like Deployment
+	Workload     string   `json:"workload" yaml:"workload"`
+	Port         int      `json:"port,omitempty" yaml:"port,omitempty"`
+	Environments []string `json:"environments" yaml:"environments"`
+}
+
+// Env is an environment with an overlay tree or settings in the fleet config
+type Env struct {
+	Name          string `json:"name" yaml:"name"`
+	Domain        string `json:"domain" yaml:"domain"`
+	GitBranch     string `json:"gitBranch" yaml:"gitBranch"`
+	SecretBackend string `json:"secretBackend" yaml:"secretBackend"`
+	Apps          int    `json:"apps" yaml:"apps"`
+}
+
+// Host is an ingress rule of an environment
+type Host struct {
+	Env          string `json:"env" yaml:"env"`
+	ingress.Rule `yaml:",inline"`
+}
+
+// Port is an entry of the port registry
+type Port struct {
+	App  string `json:"app" yaml:"app"`
+	Port int    `json:"port" yaml:"port"`
+}
+
+// Secret is an encrypted secret of an app overlay
+type Secret struct {
+	Env       string   `json:"env" yaml:"env"`
+	App       string   `json:"app" yaml:"app"`
+	Name      string   `json:"name" yaml:"name"`
+	Namespace string   `json:"namespace" yaml:"namespace"`
+	Backend   string   `json:"backend" yaml:"backend"`
+	Keys      []string `json:"keys" yaml:"keys"`
+	File      string   `json:"file" yaml:"file"`
+}
+
+// Apps returns the apps under the base directory and the environments they
+// have an overlay in
+func Apps() ([]App, error) {
+	names, err := subdirectories(config.BaseTemplatePath)
+	if err != nil {
+		return nil, err
+	}
+	envs, err := envDirectories()
+	if err != nil {
+		return nil, err
+	}
+	ports, err := storage.Ports()
+	if err != nil {
+		return nil, err
+	}
+	apps := make([]App, 0, len(names))
+	for _, name := range names {
+		app := App{Name: name, Port: ports[name], Environments: []string{}}
+		if workloadFile, err := application.FindWorkloadFile(filepath.Join(config.BaseTemplatePath, name)); err == nil {
+			file, err := manifest.Load(workloadFile)
+			if err != nil {
+				return nil, err
+			}
+			if workload := file.FindWorkload(); workload != nil {
+				app.Workload = manifest.Kind(workload)
+			}
+		}
+		for _, env := range envs {
+			if render.HasKustomization(filepath.Join(config.AppTemplatePath, env, name)) {
+				app.Environments = append(app.Environments, env)
+			}
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+// Envs returns the environments of the overlay tree and the fleet config
+func Envs(fleetConfig *config.FleetConfig) ([]Env, error) {
+	names, err := envDirectories()
+	if err != nil {
+		return nil, err
+	}
+	for _, environment := range fleetConfig.Environments {
+		if !contains(names, environment.Name) {
+			names = append(names, environment.Name)
+		}
+	}
+	sort.Strings(names)
+	envs := make([]Env, 0, len(names))
+	for _, name := range names {
+		environment := fleetConfig.Environment(name)
+		apps, err := overlays(name)
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, Env{
+			Name:          name,
+			Domain:        environment.Domain,
+			GitBranch:     environment.GitBranch,
+			SecretBackend: environment.SecretBackend,
+			Apps:          len(apps),
+		})
+	}
+	return envs, nil
+}
+
+// Hosts returns the ingress rules of every environment
+func Hosts() ([]Host, error) {
+	envs, err := envDirectories()
+	if err != nil {
+		return nil, err
+	}
+	hosts := []Host{}
+	for _, env := range envs {
+		rules, err := ingress.Rules(env)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			hosts = append(hosts, Host{Env: env, Rule: rule})
+		}
+	}
+	return hosts, nil
+}
+
+// Ports returns the port registry sorted by port
+func Ports() ([]Port, error) {
+	registry, err := storage.Ports()
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]Port, 0, len(registry))
+	for app, port := range registry {
+		ports = append(ports, Port{App: app, Port: port})
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports, nil
+}
+
+// Secrets returns the sealed and SOPS encrypted secrets of every app overlay
+func Secrets() ([]Secret, error) {
+	envs, err := envDirectories()
+	if err != nil {
+		return nil, err
+	}
+	secrets := []Secret{}
+	for _, env := range envs {
+		apps, err := overlays(env)
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			found, err := secret.FindEncryptedSecrets(filepath.Join(config.AppTemplatePath, env, app))
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range found {
+				backend := config.SealedSecretsBackend
+				if s.Kind != "SealedSecret" {
+					backend = config.SopsAgeBackend
+				}
+				secrets = append(secrets, Secret{
+					Env:       env,
+					App:       app,
+					Name:      s.SecretName(),
+					Namespace: s.Metadata.Namespace,
+					Backend:   backend,
+					Keys:      s.Keys(),
+					File:      s.File,
+				})
+			}
+		}
+	}
+	return secrets, nil
+}
+
+// envDirectories returns the environments with an overlay tree
+func envDirectories() ([]string, error) {
+	dirs, err := subdirectories(config.AppTemplatePath)
+	if err != nil {
+		return nil, err
+	}
+	var envs []string
+	for _, dir := range dirs {
+		if filepath.Join(config.AppTemplatePath, dir) != config.BaseTemplatePath {
+			envs = append(envs, dir)
+		}
+	}
+	return envs, nil
+}
+
+// overlays returns the app overlays of an environment
+func overlays(env string) ([]string, error) {
+	dirs, err := subdirectories(filepath.Join(config.AppTemplatePath, env))
+	if err != nil {
+		return nil, err
+	}
+	var apps []string
+	for _, dir := range dirs {
+		if dir != "common" && render.HasKustomization(filepath.Join(config.AppTemplatePath, env, dir)) {
+			apps = append(apps, dir)
+		}
+	}
+	return apps, nil
+}
+
+// subdirectories returns the sorted directory names in dir, none when dir is missing
+func subdirectories(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/africhild/fleet-infra/src/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatYAML  = "yaml"
+)
+
+// Lists are the inventories List can assemble
+var Lists = []string{"apps", "envs", "hosts", "ports", "secrets"}
+
+// Table is the table format of a list
+type Table struct {
+	Header []string
+	Rows   [][]string
+}
+
+// List assembles the named inventory, returning it as a value for the json and
+// yaml formats and as a table
+func List(name string, fleetConfig *config.FleetConfig) (interface{}, Table, error) {
+	switch name {
+	case "apps":
+		apps, err := Apps()
+		table := Table{Header: []string{"NAME", "WORKLOAD", "PORT", "ENVIRONMENTS"}}
+		for _, app := range apps {
+			table.Rows = append(table.Rows, []string{app.Name, app.Workload, portString(app.Port), strings.Join(app.Environments, ",")})
+		}
+		return apps, table, err
+	case "envs":
+		envs, err := Envs(fleetConfig)
+		table := Table{Header: []string{"NAME", "DOMAIN", "BRANCH", "SECRETS", "APPS"}}
+		for _, env := range envs {
+			table.Rows = append(table.Rows, []string{env.Name, env.Domain, env.GitBranch, env.SecretBackend, strconv.Itoa(env.Apps)})
+		}
+		return envs, table, err
+	case "hosts":
+		hosts, err := Hosts()
+		table := Table{Header: []string{"ENV", "HOST", "PATH", "SERVICE", "PORT"}}
+		for _, host := range hosts {
+			table.Rows = append(table.Rows, []string{host.Env, host.Host, host.Path, host.Service, portString(host.Port)})
+		}
+		return hosts, table, err
+	case "ports":
+		ports, err := Ports()
+		table := Table{Header: []string{"APP", "PORT"}}
+		for _, port := range ports {
+			table.Rows = append(table.Rows, []string{port.App, strconv.Itoa(port.Port)})
+		}
+		return ports, table, err
+	case "secrets":
+		secrets, err := Secrets()
+		table := Table{Header: []string{"ENV", "APP", "NAME", "BACKEND", "KEYS", "FILE"}}
+		for _, s := range secrets {
+			table.Rows = append(table.Rows, []string{s.Env, s.App, s.Name, s.Backend, strings.Join(s.Keys, ","), s.File})
+		}
+		return secrets, table, err
+	}
+	return nil, Table{}, fmt.Errorf("unknown list %s, use %s", name, strings.Join(Lists, "|"))
+}
+
+// Print writes a list in the given format
+func Print(w io.Writer, format string, value interface{}, table Table) error {
+	switch format {
+	case FormatTable:
+		writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, strings.Join(table.Header, "\t"))
+		for _, row := range table.Rows {
+			fmt.Fprintln(writer, strings.Join(row, "\t"))
+		}
+		return writer.Flush()
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case FormatYAML:
+		data, err := yaml.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	return fmt.Errorf("unknown output format %s, use %s|%s|%s", format, FormatTable, FormatJSON, FormatYAML)
+}
+
+func portString(port int) string {
+	if port == 0 {
+		return "-"
+	}
+	return strconv.Itoa(port)
+}
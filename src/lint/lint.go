@@ -0,0 +1,266 @@
+package lint
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/render"
+	"gopkg.in/yaml.v3"
+)
+
+// Severities of a finding
+const (
+	Error   = "error"
+	Warning = "warning"
+	Off     = "off"
+)
+
+// Object is a rendered manifest of an environment
+type Object struct {
+	Env  string
+	Kind string
+	Name string
+	// Source is the overlay or file the object was rendered from
+	Source string
+	Data   map[string]interface{}
+}
+
+// Field returns the value at a dotted path like spec.replicas, or nil
+func (o Object) Field(path string) interface{} {
+	var value interface{} = o.Data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// Containers returns the containers and init containers of a workload
+func (o Object) Containers() []map[string]interface{} {
+	var podSpec string
+	switch o.Kind {
+	case "Pod":
+		podSpec = "spec"
+	case "CronJob":
+		podSpec = "spec.jobTemplate.spec.template.spec"
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+		podSpec = "spec.template.spec"
+	default:
+		return nil
+	}
+	var containers []map[string]interface{}
+	for _, field := range []string{"initContainers", "containers"} {
+		list, _ := o.Field(podSpec + "." + field).([]interface{})
+		for _, item := range list {
+			if container, ok := item.(map[string]interface{}); ok {
+				containers = append(containers, container)
+			}
+		}
+	}
+	return containers
+}
+
+// Finding is a rule violation
+type Finding struct {
+	Rule     string
+	Severity string
+	Env      string
+	Source   string
+	// Object is Kind/name, empty for findings about a whole overlay
+	Object  string
+	Message string
+}
+
+func (f Finding) String() string {
+	location := f.Source
+	if f.Object != "" {
+		location += " " + f.Object
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", f.Severity, location, f.Message, f.Rule)
+}
+
+// Result holds the findings of a lint run
+type Result struct {
+	Objects  int
+	Findings []Finding
+}
+
+// Count returns the number of findings of a severity
+func (r *Result) Count(severity string) int {
+	n := 0
+	for _, finding := range r.Findings {
+		if finding.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+// Environments returns the environments with an overlay tree
+func Environments() ([]string, error) {
+	entries, err := os.ReadDir(config.AppTemplatePath)
+	if err != nil {
+		return nil, err
+	}
+	var envs []string
+	for _, entry := range entries {
+		if entry.IsDir() && filepath.Join(config.AppTemplatePath, entry.Name()) != config.BaseTemplatePath {
+			envs = append(envs, entry.Name())
+		}
+	}
+	return envs, nil
+}
+
+// Lint renders the overlays of the environments and checks them against the
+// built-in rules and the custom rules of the fleet config
+func Lint(envs []string, fleetConfig *config.FleetConfig) (*Result, error) {
+	rules, err := Rules(fleetConfig.LintRules)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	for _, env := range envs {
+		environment := fleetConfig.Environment(env)
+		severities := make(map[string]string, len(rules))
+		for _, rule := range rules {
+			severity := rule.Severity(env)
+			if override, ok := environment.Lint[rule.Name]; ok {
+				severity = override
+			}
+			if severity != Error && severity != Warning && severity != Off {
+				return nil, fmt.Errorf("%s: invalid severity %q for rule %s, use %s|%s|%s", env, severity, rule.Name, Error, Warning, Off)
+			}
+			severities[rule.Name] = severity
+		}
+		for name := range environment.Lint {
+			if _, ok := severities[name]; !ok {
+				return nil, fmt.Errorf("%s: unknown lint rule %s", env, name)
+			}
+		}
+
+		sources, err := envSources(env)
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range sources {
+			objects, err := renderSource(env, source)
+			if err != nil {
+				return nil, err
+			}
+			result.Objects += len(objects)
+			for _, rule := range rules {
+				severity := severities[rule.Name]
+				if severity == Off {
+					continue
+				}
+				report := func(object, message string) {
+					result.Findings = append(result.Findings, Finding{
+						Rule: rule.Name, Severity: severity, Env: env, Source: source, Object: object, Message: message,
+					})
+				}
+				if rule.CheckSource != nil {
+					messages, err := rule.CheckSource(source)
+					if err != nil {
+						return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+					}
+					for _, message := range messages {
+						report("", message)
+					}
+				}
+				if rule.Check == nil {
+					continue
+				}
+				for _, object := range objects {
+					messages, err := rule.Check(environment, object)
+					if err != nil {
+						return nil, fmt.Errorf("rule %s: %s %s/%s: %w", rule.Name, source, object.Kind, object.Name, err)
+					}
+					for _, message := range messages {
+						report(object.Kind+"/"+object.Name, message)
+					}
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// envSources returns what an environment is rendered from: its overlay tree
+// when it has a kustomization, else its overlays and loose manifests
+func envSources(env string) ([]string, error) {
+	dir := filepath.Join(config.AppTemplatePath, env)
+	if render.HasKustomization(dir) {
+		return []string{dir}, nil
+	}
+	var sources []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && render.HasKustomization(path) {
+				sources = append(sources, path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+			sources = append(sources, path)
+		}
+		return nil
+	})
+	sort.Strings(sources)
+	return sources, err
+}
+
+// renderSource returns the objects of an overlay or a loose manifest
+func renderSource(env, source string) ([]Object, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if info.IsDir() {
+		data, err = render.Build(source)
+		if err != nil {
+			return nil, fmt.Errorf("overlay %s does not render: %w", source, err)
+		}
+	} else if data, err = os.ReadFile(source); err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc map[string]interface{}
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", source, err)
+		}
+		object := Object{Env: env, Source: source, Data: doc}
+		object.Kind, _ = object.Field("kind").(string)
+		object.Name, _ = object.Field("metadata.name").(string)
+		if object.Kind != "" {
+			objects = append(objects, object)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package lint
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
+	"github.com/africhild/fleet-infra/src/secret"
+)
+
+// Rule checks the rendered objects of an environment or the overlay sources
+type Rule struct {
+	Name        string
+	Description string
+	// Severity returns the default severity of the rule in env
+	Severity func(env string) string
+	// Check returns the violations of a rendered object
+	Check func(environment config.Environment, object Object) ([]string, error)
+	// CheckSource returns the violations of an overlay or loose manifest, for
+	// rules that need what rendering hides
+	CheckSource func(source string) ([]string, error)
+}
+
+// productionEnv is the environment where the latest tag is an error
+const productionEnv = "production"
+
+func always(severity string) func(string) string {
+	return func(string) string { return severity }
+}
+
+// BuiltinRules are the rules every environment is checked against
+var BuiltinRules = []Rule{
+	{
+		Name:        "latest-tag",
+		Description: "images must be pinned to a tag other than latest",
+		Severity: func(env string) string {
+			if env == productionEnv {
+				return Error
+			}
+			return Off
+		},
+		Check: checkLatestTag,
+	},
+	{
+		Name:        "resources",
+		Description: "containers must request cpu and memory and limit memory",
+		Severity:    always(Error),
+		Check:       checkResources,
+	},
+	{
+		Name:        "privileged",
+		Description: "containers must not run privileged",
+		Severity:    always(Error),
+		Check:       checkPrivileged,
+	},
+	{
+		Name:        "ingress-host",
+		Description: "ingress hosts must be in the domain of the environment",
+		Severity:    always(Error),
+		Check:       checkIngressHost,
+	},
+	{
+		Name:        "sealed-secret-namespace",
+		Description: "sealed secrets must be sealed for the namespace of their overlay",
+		Severity:    always(Error),
+		CheckSource: checkSealedSecretNamespace,
+	},
+}
+
+// Rules returns the built-in rules followed by the custom ones
+func Rules(custom []config.LintRule) ([]Rule, error) {
+	rules := append([]Rule{}, BuiltinRules...)
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		names[rule.Name] = true
+	}
+	for _, definition := range custom {
+		if definition.Name == "" {
+			return nil, fmt.Errorf("lint rule without a name")
+		}
+		if names[definition.Name] {
+			return nil, fmt.Errorf("lint rule %s is defined twice", definition.Name)
+		}
+		names[definition.Name] = true
+		rule, err := customRule(definition)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// customRule compiles the violation expression of a custom rule
+func customRule(definition config.LintRule) (Rule, error) {
+	violation, err := template.New(definition.Name).Option("missingkey=zero").Parse(definition.Violation)
+	if err != nil {
+		return Rule{}, fmt.Errorf("error parsing lint rule %s: %w", definition.Name, err)
+	}
+	severity := definition.Severity
+	if severity == "" {
+		severity = Error
+	}
+	message := definition.Message
+	if message == "" {
+		message = "violates " + definition.Name
+	}
+	return Rule{
+		Name:        definition.Name,
+		Description: definition.Message,
+		Severity:    always(severity),
+		Check: func(environment config.Environment, object Object) ([]string, error) {
+			if len(definition.Kinds) > 0 && !contains(definition.Kinds, object.Kind) {
+				return nil, nil
+			}
+			var out strings.Builder
+			if err := violation.Execute(&out, object); err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(out.String()) == "true" {
+				return []string{message}, nil
+			}
+			return nil, nil
+		},
+	}, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containerName(container map[string]interface{}) string {
+	name, _ := container["name"].(string)
+	return name
+}
+
+func checkLatestTag(environment config.Environment, object Object) ([]string, error) {
+	var messages []string
+	for _, container := range object.Containers() {
+		image, _ := container["image"].(string)
+		if image == "" || strings.Contains(image, "@") {
+			continue
+		}
+		name := image[strings.LastIndex(image, "/")+1:]
+		i := strings.LastIndex(name, ":")
+		switch {
+		case i < 0:
+			messages = append(messages, fmt.Sprintf("container %s uses image %s without a tag", containerName(container), image))
+		case name[i+1:] == "latest":
+			messages = append(messages, fmt.Sprintf("container %s uses image %s", containerName(container), image))
+		}
+	}
+	return messages, nil
+}
+
+func checkResources(environment config.Environment, object Object) ([]string, error) {
+	var messages []string
+	for _, container := range object.Containers() {
+		resources, _ := container["resources"].(map[string]interface{})
+		var missing []string
+		for _, field := range []string{"requests.cpu", "requests.memory", "limits.memory"} {
+			parts := strings.SplitN(field, ".", 2)
+			values, _ := resources[parts[0]].(map[string]interface{})
+			if values[parts[1]] == nil {
+				missing = append(missing, field)
+			}
+		}
+		if len(missing) > 0 {
+			messages = append(messages, fmt.Sprintf("container %s sets no %s", containerName(container), strings.Join(missing, ", ")))
+		}
+	}
+	return messages, nil
+}
+
+func checkPrivileged(environment config.Environment, object Object) ([]string, error) {
+	var messages []string
+	for _, container := range object.Containers() {
+		securityContext, _ := container["securityContext"].(map[string]interface{})
+		if privileged, _ := securityContext["privileged"].(bool); privileged {
+			messages = append(messages, fmt.Sprintf("container %s runs privileged", containerName(container)))
+		}
+	}
+	return messages, nil
+}
+
+func checkIngressHost(environment config.Environment, object Object) ([]string, error) {
+	if object.Kind != "Ingress" {
+		return nil, nil
+	}
+	var hosts []string
+	rules, _ := object.Field("spec.rules").([]interface{})
+	for _, item := range rules {
+		rule, _ := item.(map[string]interface{})
+		if host, ok := rule["host"].(string); ok {
+			hosts = append(hosts, host)
+		}
+	}
+	tls, _ := object.Field("spec.tls").([]interface{})
+	for _, item := range tls {
+		entry, _ := item.(map[string]interface{})
+		list, _ := entry["hosts"].([]interface{})
+		for _, host := range list {
+			if host, ok := host.(string); ok {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	var messages []string
+	for _, host := range hosts {
+		if _, ok := environment.Subdomain(host); !ok {
+			messages = append(messages, fmt.Sprintf("host %s is not in the domain %s", host, environment.Domain))
+		}
+	}
+	return messages, nil
+}
+
+// checkSealedSecretNamespace compares the namespace sealed secrets were sealed
+// for with the namespace the overlay deploys to. Rendering would hide a
+// mismatch, kustomize overrides the namespace but the controller cannot decrypt
+// a secret sealed for another namespace.
+func checkSealedSecretNamespace(source string) ([]string, error) {
+	kustomizationFile := render.KustomizationFile(source)
+	if kustomizationFile == "" {
+		return nil, nil
+	}
+	file, err := manifest.Load(kustomizationFile)
+	if err != nil {
+		return nil, err
+	}
+	// the kind of a kustomization is optional
+	if len(file.Docs) == 0 || manifest.Scalar(file.Docs[0], "namespace") == "" {
+		return nil, nil
+	}
+	doc := file.Docs[0]
+	namespace := manifest.Scalar(doc, "namespace")
+	secrets, err := secret.FindSealedSecrets(source)
+	if err != nil {
+		return nil, err
+	}
+	var messages []string
+	for _, s := range secrets {
+		if s.Metadata.Annotations["sealedsecrets.bitnami.com/cluster-wide"] == "true" {
+			continue
+		}
+		if s.Metadata.Namespace != namespace {
+			messages = append(messages, fmt.Sprintf("sealed secret %s in %s is sealed for namespace %q, the overlay deploys to %s", s.Metadata.Name, s.File, s.Metadata.Namespace, namespace))
+		}
+	}
+	return messages, nil
+}
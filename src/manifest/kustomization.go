@@ -0,0 +1,57 @@
+package manifest
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AddResource appends resource to the resources of the kustomization at path.
+// It reports false when the resource is already listed.
+func AddResource(path, resource string) (bool, error) {
+	file, err := Load(path)
+	if err != nil {
+		return false, err
+	}
+	doc := file.Find("Kustomization")
+	if doc == nil {
+		return false, fmt.Errorf("no kustomization found in %s", path)
+	}
+	resources := Get(doc, "resources")
+	if resources == nil || resources.Kind != yaml.SequenceNode {
+		resources = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		Set(doc, "resources", resources)
+	}
+	for _, existing := range resources.Content {
+		if existing.Value == resource {
+			return false, nil
+		}
+	}
+	resources.Style = 0
+	resources.Content = append(resources.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: resource})
+	return true, file.Save()
+}
+
+// RemoveResource removes resource from the resources of the kustomization at
+// path. It reports false when the resource is not listed.
+func RemoveResource(path, resource string) (bool, error) {
+	file, err := Load(path)
+	if err != nil {
+		return false, err
+	}
+	doc := file.Find("Kustomization")
+	if doc == nil {
+		return false, fmt.Errorf("no kustomization found in %s", path)
+	}
+	resources := Get(doc, "resources")
+	if resources == nil || resources.Kind != yaml.SequenceNode {
+		return false, nil
+	}
+	for i, existing := range resources.Content {
+		if existing.Value == resource {
+			resources.Content = append(resources.Content[:i], resources.Content[i+1:]...)
+			return true, file.Save()
+		}
+	}
+	return false, nil
+}
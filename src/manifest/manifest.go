@@ -0,0 +1,183 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is a multi-document yaml manifest kept as nodes so that key order and
+// comments survive an edit
+type File struct {
+	Path string
+	Docs []*yaml.Node
+
+	style sequenceStyle
+}
+
+// Load reads every document of the manifest at path
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse decodes the documents of data, path is only used for error messages
+func Parse(path string, data []byte) (*File, error) {
+	file := &File{Path: path}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		file.Docs = append(file.Docs, doc.Content[0])
+	}
+	file.style.record(file.Docs)
+	return file, nil
+}
+
+// Bytes encodes the documents back to yaml, block sequences keep the
+// indentation they were parsed with
+func (f *File) Bytes() ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	for _, doc := range f.Docs {
+		if err := encoder.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return f.style.apply(buffer.Bytes())
+}
+
+// Save writes the documents back to the file they were loaded from
+func (f *File) Save() error {
+	data, err := f.Bytes()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.Path, data, 0644)
+}
+
+// Find returns the first document of the given kind, or nil
+func (f *File) Find(kind string) *yaml.Node {
+	for _, doc := range f.Docs {
+		if Kind(doc) == kind {
+			return doc
+		}
+	}
+	return nil
+}
+
+// Kind returns the kind of a document
+func Kind(doc *yaml.Node) string {
+	return Scalar(doc, "kind")
+}
+
+// Get follows the mapping keys in path and returns the node found, or nil
+func Get(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+				break
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+// Scalar returns the value of the scalar at path, or "" when it is missing
+func Scalar(node *yaml.Node, path ...string) string {
+	value := Get(node, path...)
+	if value == nil || value.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return value.Value
+}
+
+// Ensure follows path like Get, creating empty mappings for missing keys
+func Ensure(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		next := Get(node, key)
+		if next == nil {
+			next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			Set(node, key, next)
+		}
+		node = next
+	}
+	return node
+}
+
+// Set replaces the value of key in a mapping node, appending it when missing
+func Set(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			// keep comments attached to the old value
+			value.LineComment = node.Content[i+1].LineComment
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		value,
+	)
+}
+
+// SetScalar sets key to a scalar value, returning the previous value
+func SetScalar(node *yaml.Node, key, value string) string {
+	if current := Get(node, key); current != nil && current.Kind == yaml.ScalarNode {
+		old := current.Value
+		current.Value = value
+		current.Tag = ""
+		current.Style = 0
+		return old
+	}
+	Set(node, key, &yaml.Node{Kind: yaml.ScalarNode, Value: value})
+	return ""
+}
+
+// Delete removes key from a mapping node, reporting whether it was present
+func Delete(node *yaml.Node, key string) bool {
+	if node == nil {
+		return false
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// FromValue converts a go value into a yaml node
+func FromValue(value interface{}) (*yaml.Node, error) {
+	var node yaml.Node
+	if err := node.Encode(value); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
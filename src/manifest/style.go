@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sequenceStyle records which block sequences of a parsed file start their
+// items at the column of their key, like
+//
+//	containers:
+//	- name: app
+//
+// yaml.v3 always indents them, so Bytes dedents them again
+type sequenceStyle struct {
+	compact map[string]bool // by path of the key
+	// fallback is the style of the first sequence, used for new ones
+	fallback bool
+	seen     bool
+}
+
+func (s *sequenceStyle) record(docs []*yaml.Node) {
+	s.compact = make(map[string]bool)
+	for i, doc := range docs {
+		walkSequences(doc, strconv.Itoa(i), 0, func(key, value *yaml.Node, path string, end int) {
+			compact := value.Column == key.Column
+			s.compact[path] = compact
+			if !s.seen {
+				s.fallback, s.seen = compact, true
+			}
+		})
+	}
+}
+
+func (s *sequenceStyle) isCompact(path string) bool {
+	if compact, ok := s.compact[path]; ok {
+		return compact
+	}
+	return s.fallback
+}
+
+// apply dedents the sequences of data that are compact in the parsed file
+func (s *sequenceStyle) apply(data []byte) ([]byte, error) {
+	if !s.seen {
+		return data, nil
+	}
+	var docs []*yaml.Node
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(doc.Content) > 0 {
+			docs = append(docs, doc.Content[0])
+		}
+	}
+	lines := strings.Split(string(data), "\n")
+	dedent := make([]int, len(lines))
+	for i, doc := range docs {
+		end := len(lines)
+		if i+1 < len(docs) {
+			end = docs[i+1].Line - 1
+		}
+		walkSequences(doc, strconv.Itoa(i), end, func(key, value *yaml.Node, path string, end int) {
+			if !s.isCompact(path) || value.Column <= key.Column {
+				return
+			}
+			// lines indented less than the dashes belong to the next key,
+			// like its head comment
+			for line := value.Line; line <= end && line <= len(lines); line++ {
+				if indentation(lines[line-1]) >= value.Column-1 {
+					dedent[line-1] += value.Column - key.Column
+				}
+			}
+		})
+	}
+	for i, n := range dedent {
+		if n > 0 {
+			lines[i] = lines[i][min(n, indentation(lines[i])):]
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// walkSequences calls fn for every non-empty block sequence that is the value
+// of a mapping key, with the last line the sequence can span
+func walkSequences(node *yaml.Node, path string, end int, fn func(key, value *yaml.Node, path string, end int)) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			valueEnd := end
+			if i+2 < len(node.Content) {
+				valueEnd = node.Content[i+2].Line - 1
+			}
+			child := path + "." + key.Value
+			if value.Kind == yaml.SequenceNode && value.Style&yaml.FlowStyle == 0 && len(value.Content) > 0 {
+				fn(key, value, child, valueEnd)
+			}
+			walkSequences(value, child, valueEnd, fn)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			itemEnd := end
+			if i+1 < len(node.Content) {
+				itemEnd = node.Content[i+1].Line - 1
+			}
+			walkSequences(item, fmt.Sprintf("%s[%d]", path, i), itemEnd, fn)
+		}
+	}
+}
+
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
@@ -0,0 +1,59 @@
+package manifest
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WorkloadKinds are the kinds that carry a pod template
+var WorkloadKinds = []string{"Deployment", "StatefulSet", "DaemonSet", "Job", "CronJob"}
+
+// FindWorkload returns the first workload document of the file, or nil
+func (f *File) FindWorkload() *yaml.Node {
+	for _, kind := range WorkloadKinds {
+		if doc := f.Find(kind); doc != nil {
+			return doc
+		}
+	}
+	return nil
+}
+
+// PodSpec returns the pod spec of a workload, creating the path when missing
+func PodSpec(workload *yaml.Node) *yaml.Node {
+	if Kind(workload) == "CronJob" {
+		return Ensure(workload, "spec", "jobTemplate", "spec", "template", "spec")
+	}
+	return Ensure(workload, "spec", "template", "spec")
+}
+
+// Containers returns the containers of a workload, followed by its init containers
+func Containers(workload *yaml.Node) []*yaml.Node {
+	podSpec := PodSpec(workload)
+	var containers []*yaml.Node
+	for _, field := range []string{"containers", "initContainers"} {
+		if list := Get(podSpec, field); list != nil && list.Kind == yaml.SequenceNode {
+			containers = append(containers, list.Content...)
+		}
+	}
+	return containers
+}
+
+// Container returns the container or init container called name. An empty name
+// selects the first container.
+func Container(workload *yaml.Node, name string) (*yaml.Node, error) {
+	containers := Containers(workload)
+	if name == "" {
+		list := Get(PodSpec(workload), "containers")
+		if list == nil || len(list.Content) == 0 {
+			return nil, fmt.Errorf("%s has no containers", Scalar(workload, "metadata", "name"))
+		}
+		return list.Content[0], nil
+	}
+	for _, container := range containers {
+		if Scalar(container, "name") == name {
+			return container, nil
+		}
+	}
+	return nil, fmt.Errorf("container %s not found in %s", name, Scalar(workload, "metadata", "name"))
+}
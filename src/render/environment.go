@@ -0,0 +1,139 @@
+package render
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// kustomizationFiles are the names kustomize looks for in a directory
+var kustomizationFiles = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// Environment renders the overlay tree dir of an environment, which may refer
+// to anything below root. When dir has no kustomization one is generated the
+// way the Flux kustomize-controller does, listing the overlays and the loose
+// manifests below dir. The tree is copied into memory, the disk is not touched.
+func Environment(root, dir string) ([]byte, error) {
+	if HasKustomization(dir) {
+		return Build(dir)
+	}
+	memory := filesys.MakeFsInMemory()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return memory.WriteFile(filepath.Join("/", path), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resources, err := generatedResources(dir, dir)
+	if err != nil {
+		return nil, err
+	}
+	kustomization, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  resources,
+	})
+	if err != nil {
+		return nil, err
+	}
+	target := filepath.Join("/", dir)
+	if err := memory.WriteFile(filepath.Join(target, "kustomization.yaml"), kustomization); err != nil {
+		return nil, err
+	}
+	kustomizer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resourceMap, err := kustomizer.Run(memory, target)
+	if err != nil {
+		return nil, err
+	}
+	return resourceMap.AsYaml()
+}
+
+// HasKustomization reports whether dir holds a kustomization
+func HasKustomization(dir string) bool {
+	return KustomizationFile(dir) != ""
+}
+
+// KustomizationFile returns the kustomization file of dir, "" when it has none
+func KustomizationFile(dir string) string {
+	for _, name := range kustomizationFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// generatedResources lists the directories with a kustomization and the
+// kubernetes manifests below dir, relative to base
+func generatedResources(base, dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	var resources []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if entry.IsDir() {
+			if HasKustomization(path) {
+				resources = append(resources, rel)
+				continue
+			}
+			nested, err := generatedResources(base, path)
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, nested...)
+			continue
+		}
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		manifest, err := isManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		if manifest {
+			resources = append(resources, rel)
+		}
+	}
+	return resources, nil
+}
+
+// isManifest reports whether the first document of a file is a kubernetes object
+func isManifest(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var object struct {
+		APIVersion string `yaml:"apiVersion"`
+		Kind       string `yaml:"kind"`
+	}
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&object); err != nil {
+		return false, nil
+	}
+	return object.APIVersion != "" && object.Kind != "", nil
+}
@@ -0,0 +1,64 @@
+package secret
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/africhild/fleet-infra/src/config"
+)
+
+// SecretBackend encrypts plaintext Secret manifests so they can be committed
+type SecretBackend interface {
+	// Name returns the backend name used in fleet.yaml
+	Name() string
+	// FileSuffix is appended to the secret name to build the committed file name
+	FileSuffix() string
+	// Encrypt reads the plaintext Secret in secretFile and writes the encrypted
+	// manifest to outputFile
+	Encrypt(secretFile, outputFile string) error
+	// Configure prepares the cluster side of the environment, if needed
+	Configure(env config.Environment) error
+}
+
+// NewBackend returns the secret backend configured for the environment
+func NewBackend(env config.Environment) (SecretBackend, error) {
+	switch env.SecretBackend {
+	case config.SealedSecretsBackend, "":
+		return &sealedSecretsBackend{cert: env.SealingCert}, nil
+	case config.SopsAgeBackend:
+		if len(env.AgeRecipients) == 0 {
+			return nil, fmt.Errorf("environment %s uses %s but has no ageRecipients", env.Name, env.SecretBackend)
+		}
+		return &sopsAgeBackend{recipients: env.AgeRecipients}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret backend %q for environment %s", env.SecretBackend, env.Name)
+	}
+}
+
+// SecretPath returns the path, relative to the app directory, of the encrypted
+// file for a named secret
+func SecretPath(name string, backend SecretBackend) string {
+	return filepath.Join("secrets", name+backend.FileSuffix())
+}
+
+// sealedSecretsBackend seals secrets with kubeseal for the sealed-secrets controller
+type sealedSecretsBackend struct {
+	cert string
+}
+
+func (b *sealedSecretsBackend) Name() string {
+	return config.SealedSecretsBackend
+}
+
+func (b *sealedSecretsBackend) FileSuffix() string {
+	return ".sealed.yaml"
+}
+
+func (b *sealedSecretsBackend) Encrypt(secretFile, outputFile string) error {
+	return SealSecret(filepath.Dir(outputFile), secretFile, filepath.Base(outputFile), b.cert)
+}
+
+func (b *sealedSecretsBackend) Configure(env config.Environment) error {
+	// the controller decrypts in-cluster, nothing to configure
+	return nil
+}
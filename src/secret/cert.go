@@ -0,0 +1,94 @@
+package secret
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+)
+
+// certExpiryWarning is how long before expiry a certificate is reported as expiring
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// FetchCertificate downloads the sealing certificate of the environment's
+// controller and stores it at env.SealingCert
+func FetchCertificate(env config.Environment) error {
+	data, err := fetchCertificate(env)
+	if err != nil {
+		return err
+	}
+
+	// the certificate is validated in a temporary file next to the current
+	// one, which is only replaced by a usable certificate
+	dir := filepath.Dir(env.SealingCert)
+	if err := common.EnsureDirectoryExists(dir); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(env.SealingCert)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := ValidateCertificate(tmp.Name()); err != nil {
+		return fmt.Errorf("fetched certificate is not usable, keeping %s: %w", env.SealingCert, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), env.SealingCert)
+}
+
+// fetchCertificate returns the PEM certificate of the controller in the kube
+// context of the environment
+func fetchCertificate(env config.Environment) ([]byte, error) {
+	args := []string{"--fetch-cert",
+		"--controller-name", config.SealedSecretsController,
+		"--controller-namespace", config.SealedSecretsNamespace,
+	}
+	if env.KubeContext != "" {
+		args = append(args, "--context", env.KubeContext)
+	}
+	var output bytes.Buffer
+	cmd := exec.Command("kubeseal", args...)
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("kubeseal --fetch-cert failed: %w", err)
+	}
+	return output.Bytes(), nil
+}
+
+// ValidateCertificate checks that the certificate in certFile can be used for
+// sealing now. It returns a warning when the certificate expires soon.
+func ValidateCertificate(certFile string) (string, error) {
+	cert, err := LoadCertificate(certFile)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("no sealing certificate at %s, run secret:cert fetch", certFile)
+	}
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return "", fmt.Errorf("certificate %s is not valid before %s", certFile, cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return "", fmt.Errorf("certificate %s expired on %s, run secret:cert fetch", certFile, cert.NotAfter.Format(time.RFC3339))
+	}
+	if cert.NotAfter.Sub(now) < certExpiryWarning {
+		return fmt.Sprintf("certificate %s expires on %s", certFile, cert.NotAfter.Format(time.RFC3339)), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,256 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"gopkg.in/yaml.v3"
+)
+
+// Reseal methods
+const (
+	ResealInProcess = "in-process"
+	ResealKubeseal  = "kubeseal"
+)
+
+// ResealResult describes what happened to one sealed secret
+type ResealResult struct {
+	File    string
+	Name    string
+	Method  string
+	Added   []string
+	Removed []string
+	Err     error
+}
+
+// Reseal re-encrypts every sealed secret under root. Secrets with a plaintext
+// <name>.env file in plaintextDir (or in plaintextDir/<namespace>) are sealed
+// in-process with certFile, the others are handed to kubeseal --re-encrypt on
+// the cluster of their environment, once its controller is known to use
+// certFile.
+func Reseal(root, certFile, plaintextDir string, fleetConfig *config.FleetConfig) ([]ResealResult, error) {
+	if _, err := ValidateCertificate(certFile); err != nil {
+		return nil, err
+	}
+	sealer, err := NewSealer(certFile)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := FindSealedSecrets(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// controllers maps an environment to the outcome of comparing its
+	// controller certificate with certFile
+	controllers := make(map[string]error)
+	var results []ResealResult
+	for _, s := range sealed {
+		result := ResealResult{File: s.File, Name: s.SecretName(), Method: ResealKubeseal}
+		namespace := s.Metadata.Namespace
+		if namespace == "" {
+			namespace = s.Spec.Template.Metadata.Namespace
+		}
+
+		plaintextFile := ""
+		if plaintextDir != "" {
+			plaintextFile, err = findPlaintext(plaintextDir, namespace, result.Name)
+			if err != nil {
+				result.Err = err
+				results = append(results, result)
+				continue
+			}
+		}
+
+		var encryptedData map[string]string
+		if plaintextFile != "" {
+			result.Method = ResealInProcess
+			encryptedData, result.Err = sealPlaintext(sealer, s, namespace, plaintextFile)
+		} else {
+			environment := fleetConfig.Environment(secretEnvironment(s.File))
+			checked, ok := controllers[environment.Name]
+			if !ok {
+				checked = checkControllerCertificate(environment, certFile)
+				controllers[environment.Name] = checked
+			}
+			if result.Err = checked; result.Err == nil {
+				encryptedData, result.Err = reencrypt(s, environment)
+			}
+		}
+		if result.Err == nil {
+			result.Err = writeEncryptedData(s, encryptedData)
+		}
+		if result.Err == nil {
+			result.Added, result.Removed = diffKeys(s.Spec.EncryptedData, encryptedData)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func findPlaintext(plaintextDir, namespace, name string) (string, error) {
+	for _, candidate := range []string{
+		filepath.Join(plaintextDir, namespace, name+".env"),
+		filepath.Join(plaintextDir, name+".env"),
+	} {
+		exists, err := common.CheckFileExists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+func sealPlaintext(sealer *Sealer, s SealedSecret, namespace, plaintextFile string) (map[string]string, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("sealed secret %s has no namespace", s.SecretName())
+	}
+	envMap, err := common.ParseEnvFile(plaintextFile, false)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string][]byte, len(envMap))
+	for key, value := range envMap {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		data[key] = decoded
+	}
+	return sealer.Seal(s.SecretName(), namespace, s.Metadata.Annotations, data)
+}
+
+// secretEnvironment returns the environment of a file under config.AppTemplatePath
+func secretEnvironment(file string) string {
+	rel, err := filepath.Rel(config.AppTemplatePath, file)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+}
+
+// checkControllerCertificate makes sure the controller kubeseal reaches for the
+// environment uses certFile, so --re-encrypt does not produce ciphertext for
+// another cluster
+func checkControllerCertificate(env config.Environment, certFile string) error {
+	expected, err := LoadCertificate(certFile)
+	if err != nil {
+		return err
+	}
+	data, err := fetchCertificate(env)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("kubeseal --fetch-cert returned no certificate for %s", env.Name)
+	}
+	if !bytes.Equal(block.Bytes, expected.Raw) {
+		return fmt.Errorf("the controller of %s (kube context %q) does not use %s, refusing to re-encrypt for another cluster", env.Name, env.KubeContext, certFile)
+	}
+	return nil
+}
+
+// reencrypt asks the controller of the environment to re-encrypt the sealed
+// secret with its latest key
+func reencrypt(s SealedSecret, env config.Environment) (map[string]string, error) {
+	file, err := manifest.Load(s.File)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := findSealedDoc(file, s.Metadata.Name)
+	if err != nil {
+		return nil, err
+	}
+	input, err := (&manifest.File{Path: s.File, Docs: []*yaml.Node{doc}}).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"--re-encrypt", "--format", "yaml",
+		"--controller-name", config.SealedSecretsController,
+		"--controller-namespace", config.SealedSecretsNamespace,
+	}
+	if env.KubeContext != "" {
+		args = append(args, "--context", env.KubeContext)
+	}
+	var output bytes.Buffer
+	cmd := exec.Command("kubeseal", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("kubeseal --re-encrypt failed: %w", err)
+	}
+
+	var resealed SealedSecret
+	if err := yaml.Unmarshal(output.Bytes(), &resealed); err != nil {
+		return nil, fmt.Errorf("error parsing kubeseal output: %w", err)
+	}
+	return resealed.Spec.EncryptedData, nil
+}
+
+// writeEncryptedData replaces spec.encryptedData of the sealed secret in its file
+func writeEncryptedData(s SealedSecret, encryptedData map[string]string) error {
+	file, err := manifest.Load(s.File)
+	if err != nil {
+		return err
+	}
+	doc, err := findSealedDoc(file, s.Metadata.Name)
+	if err != nil {
+		return err
+	}
+	data := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, key := range sortedKeys(encryptedData) {
+		manifest.SetScalar(data, key, encryptedData[key])
+	}
+	manifest.Set(manifest.Ensure(doc, "spec"), "encryptedData", data)
+	return file.Save()
+}
+
+func findSealedDoc(file *manifest.File, name string) (*yaml.Node, error) {
+	for _, doc := range file.Docs {
+		if manifest.Kind(doc) == "SealedSecret" && manifest.Scalar(doc, "metadata", "name") == name {
+			return doc, nil
+		}
+	}
+	return nil, fmt.Errorf("sealed secret %s not found in %s", name, file.Path)
+}
+
+func diffKeys(before, after map[string]string) (added, removed []string) {
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
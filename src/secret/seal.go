@@ -0,0 +1,103 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sealing scope annotations understood by the sealed-secrets controller
+const (
+	clusterWideAnnotation   = "sealedsecrets.bitnami.com/cluster-wide"
+	namespaceWideAnnotation = "sealedsecrets.bitnami.com/namespace-wide"
+	sessionKeyBytes         = 32
+)
+
+// LoadCertificate reads a sealed-secrets controller certificate from a PEM file
+func LoadCertificate(certFile string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Sealer encrypts secret values in-process the same way kubeseal does
+type Sealer struct {
+	publicKey *rsa.PublicKey
+}
+
+// NewSealer returns a sealer for the certificate in certFile
+func NewSealer(certFile string) (*Sealer, error) {
+	cert, err := LoadCertificate(certFile)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("certificate %s does not hold an RSA public key", certFile)
+	}
+	return &Sealer{publicKey: publicKey}, nil
+}
+
+// Seal encrypts every value of data for the secret name/namespace, honouring the
+// scope annotations of the sealed secret
+func (s *Sealer) Seal(name, namespace string, annotations map[string]string, data map[string][]byte) (map[string]string, error) {
+	label := []byte(namespace + "/" + name)
+	if annotations[clusterWideAnnotation] == "true" {
+		label = []byte{}
+	} else if annotations[namespaceWideAnnotation] == "true" {
+		label = []byte(namespace)
+	}
+
+	encrypted := make(map[string]string, len(data))
+	for key, value := range data {
+		ciphertext, err := hybridEncrypt(rand.Reader, s.publicKey, value, label)
+		if err != nil {
+			return nil, fmt.Errorf("error sealing %s: %w", key, err)
+		}
+		encrypted[key] = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+	return encrypted, nil
+}
+
+// hybridEncrypt encrypts plaintext with a random AES-GCM session key that is itself
+// encrypted with RSA-OAEP, producing the payload format of the controller
+func hybridEncrypt(rnd io.Reader, publicKey *rsa.PublicKey, plaintext, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, sessionKeyBytes)
+	if _, err := io.ReadFull(rnd, sessionKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	rsaCiphertext, err := rsa.EncryptOAEP(sha256.New(), rnd, publicKey, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ciphertext, uint16(len(rsaCiphertext)))
+	ciphertext = append(ciphertext, rsaCiphertext...)
+	// the session key is never reused so a zero nonce is safe
+	zeroNonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ciphertext, zeroNonce, plaintext, nil), nil
+}
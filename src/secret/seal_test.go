@@ -0,0 +1,120 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed sealing certificate and returns
+// its path and private key
+func writeTestCertificate(t *testing.T) (string, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sealed-secret"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, key
+}
+
+// hybridDecrypt reverses hybridEncrypt the way the controller does
+func hybridDecrypt(key *rsa.PrivateKey, ciphertext, label []byte) ([]byte, error) {
+	size := int(binary.BigEndian.Uint16(ciphertext))
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, ciphertext[2:2+size], label)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext[2+size:], nil)
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	certFile, key := writeTestCertificate(t)
+	sealer, err := NewSealer(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		label       string
+	}{
+		{"strict", nil, "staging/api-secrets"},
+		{"namespace-wide", map[string]string{namespaceWideAnnotation: "true"}, "staging"},
+		{"cluster-wide", map[string]string{clusterWideAnnotation: "true"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := map[string][]byte{"DB_PASSWORD": []byte("s3cret"), "EMPTY": {}}
+			sealed, err := sealer.Seal("api-secrets", "staging", test.annotations, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range data {
+				ciphertext, err := base64.StdEncoding.DecodeString(sealed[name])
+				if err != nil {
+					t.Fatal(err)
+				}
+				plaintext, err := hybridDecrypt(key, ciphertext, []byte(test.label))
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if string(plaintext) != string(value) {
+					t.Errorf("%s: got %q, want %q", name, plaintext, value)
+				}
+			}
+		})
+	}
+}
+
+func TestSealIsBoundToNamespaceAndName(t *testing.T) {
+	certFile, key := writeTestCertificate(t)
+	sealer, err := NewSealer(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealer.Seal("api-secrets", "staging", nil, map[string][]byte{"KEY": []byte("value")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed["KEY"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hybridDecrypt(key, ciphertext, []byte("production/api-secrets")); err == nil {
+		t.Error("secret sealed for staging decrypted with the production label")
+	}
+}
@@ -7,12 +7,36 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/africhild/fleet-infra/src/common"
-	"gopkg.in/yaml.v2"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"gopkg.in/yaml.v3"
 )
 
+// DefaultSecretName returns the secret name used when none is given
+func DefaultSecretName(appName, env string) string {
+	return fmt.Sprintf("%s.%s.secret", appName, env)
+}
+
+// secretNameLabelPattern matches a DNS-1123 label
+var secretNameLabelPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// ValidateSecretName checks that name is a DNS-1123 subdomain, dot separated
+// DNS-1123 labels of at most 253 characters
+func ValidateSecretName(name string) error {
+	valid := len(name) <= 253
+	for _, label := range strings.Split(name, ".") {
+		valid = valid && secretNameLabelPattern.MatchString(label)
+	}
+	if !valid {
+		return fmt.Errorf("invalid secret name %q, use lowercase letters, digits, - and .", name)
+	}
+	return nil
+}
+
 // addSealedSecretToKustomization adds the sealed secret file to the kustomization.yaml file
 func AddSealedSecretToKustomization(sealedSecretFileName, kustomizationFile string) error {
 	file, err := os.OpenFile(kustomizationFile, os.O_RDWR, 0644)
@@ -55,18 +79,28 @@ func AddSealedSecretToKustomization(sealedSecretFileName, kustomizationFile stri
 	return nil
 }
 
-// addSecretKeysToDeployment adds the secret keys to the deployment.yaml file
-func AddSecretKeysToDeployment(secretFileName, deploymentFile, envFile string) error {
-	file, err := os.OpenFile(deploymentFile, os.O_RDWR, 0644)
+// secretKeyEnvVar is an env var that reads its value from a secret key
+type secretKeyEnvVar struct {
+	Name      string `yaml:"name"`
+	ValueFrom struct {
+		SecretKeyRef struct {
+			Name string `yaml:"name"`
+			Key  string `yaml:"key"`
+		} `yaml:"secretKeyRef"`
+	} `yaml:"valueFrom"`
+}
+
+// addSecretKeysToDeployment adds the secret keys to the named containers of the
+// deployment.yaml file. Earlier references to the same secret are replaced, an
+// empty container list selects the first container.
+func AddSecretKeysToDeployment(secretName, deploymentFile, envFile string, containers []string) error {
+	file, err := manifest.Load(deploymentFile)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	var deployment map[string]interface{}
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(&deployment); err != nil {
-		return err
+	workload := file.FindWorkload()
+	if workload == nil {
+		return fmt.Errorf("no workload found in %s", deploymentFile)
 	}
 
 	// Prepare the secret keys to be added
@@ -74,80 +108,79 @@ func AddSecretKeysToDeployment(secretFileName, deploymentFile, envFile string) e
 	if err != nil {
 		return err
 	}
-
-	var envVars []map[string]interface{}
-	secretFileName = strings.TrimSuffix(secretFileName, ".yaml")
+	keys := make([]string, 0, len(envMap))
 	for key := range envMap {
-		envVar := map[string]interface{}{
-			"name": key,
-			"valueFrom": map[string]interface{}{
-				"secretKeyRef": map[string]interface{}{
-					"name": secretFileName,
-					"key":  key,
-				},
-			},
-		}
-		envVars = append(envVars, envVar)
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	// Traverse to the containers section in the deployment
-	spec, ok := deployment["spec"].(map[interface{}]interface{})
-	if !ok {
-		return fmt.Errorf("invalid deployment.yaml structure")
+	if len(containers) == 0 {
+		containers = []string{""}
 	}
-	template, ok := spec["template"].(map[interface{}]interface{})
-	if !ok {
-		return fmt.Errorf("invalid deployment.yaml structure")
-	}
-	templateSpec, ok := template["spec"].(map[interface{}]interface{})
-	if !ok {
-		return fmt.Errorf("invalid deployment.yaml structure")
-	}
-	containers, ok := templateSpec["containers"].([]interface{})
-	if !ok {
-		return fmt.Errorf("invalid deployment.yaml structure")
-	}
-
-	// Add the env vars to the first container (assuming there's at least one container)
-	firstContainer, ok := containers[0].(map[interface{}]interface{})
-	if !ok {
-		return fmt.Errorf("invalid deployment.yaml structure")
+	for _, name := range containers {
+		container, err := manifest.Container(workload, name)
+		if err != nil {
+			return err
+		}
+		var envVars []*yaml.Node
+		if env := manifest.Get(container, "env"); env != nil {
+			for _, item := range env.Content {
+				if manifest.Scalar(item, "valueFrom", "secretKeyRef", "name") == secretName {
+					continue
+				}
+				if _, ok := envMap[manifest.Scalar(item, "name")]; ok {
+					continue
+				}
+				envVars = append(envVars, item)
+			}
+		}
+		for _, key := range keys {
+			envVar := secretKeyEnvVar{Name: key}
+			envVar.ValueFrom.SecretKeyRef.Name = secretName
+			envVar.ValueFrom.SecretKeyRef.Key = key
+			node, err := manifest.FromValue(envVar)
+			if err != nil {
+				return err
+			}
+			envVars = append(envVars, node)
+		}
+		manifest.Set(container, "env", &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: envVars})
 	}
-	firstContainer["env"] = envVars
 
 	// Write the updated deployment back to the file
-	var buffer bytes.Buffer
-	encoder := yaml.NewEncoder(&buffer)
-	if err := encoder.Encode(deployment); err != nil {
-		return err
-	}
-	encoder.Close()
-
-	err = ioutil.WriteFile(deploymentFile, buffer.Bytes(), 0644)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return file.Save()
 }
 
 // createSecretYaml generates a Kubernetes Secret YAML string
-func CreateSecretYaml(appName, env string, envMap map[string]string) string {
+func CreateSecretYaml(name, namespace string, envMap map[string]string) string {
+	keys := make([]string, 0, len(envMap))
+	for key := range envMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
 	var buffer bytes.Buffer
 	buffer.WriteString("apiVersion: v1\n")
 	buffer.WriteString("kind: Secret\n")
-	buffer.WriteString(fmt.Sprintf("metadata:\n  name: %s.%s.secret\n  namespace: %s\n", appName, env, env))
+	buffer.WriteString(fmt.Sprintf("metadata:\n  name: %s\n  namespace: %s\n", name, namespace))
 	buffer.WriteString("type: Opaque\n")
 	buffer.WriteString("data:\n")
-	for key, value := range envMap {
-		buffer.WriteString(fmt.Sprintf("  %s: %s\n", key, value))
+	for _, key := range keys {
+		buffer.WriteString(fmt.Sprintf("  %s: %s\n", key, envMap[key]))
 	}
 	return buffer.String()
 }
 
 // sealSecret seals a Kubernetes Secret YAML file using kubeseal
-func SealSecret(base_path, inputFile, outputFile string) error {
-	cmd := exec.Command("kubeseal", "--format", "yaml", "--cert", "./pub-sealed-secrets.pem")
+func SealSecret(base_path, inputFile, outputFile, certFile string) error {
+	warning, err := ValidateCertificate(certFile)
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		fmt.Println("Warning:", warning)
+	}
+	cmd := exec.Command("kubeseal", "--format", "yaml", "--cert", certFile)
 	input, err := os.Open(inputFile)
 	if err != nil {
 		return err
@@ -0,0 +1,280 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// sopsEncryptedRegex limits encryption to the secret payload, as recommended by Flux
+	sopsEncryptedRegex = "^(data|stringData)$"
+	sopsVersion        = "3.8.1"
+	sopsNonceSize      = 32
+)
+
+// sopsAgeBackend encrypts secrets in-process in the SOPS format for age recipients,
+// decrypted in-cluster by the Flux kustomize-controller
+type sopsAgeBackend struct {
+	recipients []string
+}
+
+func (b *sopsAgeBackend) Name() string {
+	return config.SopsAgeBackend
+}
+
+func (b *sopsAgeBackend) FileSuffix() string {
+	return ".sops.yaml"
+}
+
+func (b *sopsAgeBackend) Encrypt(secretFile, outputFile string) error {
+	file, err := manifest.Load(secretFile)
+	if err != nil {
+		return err
+	}
+	if len(file.Docs) != 1 || file.Docs[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("%s must hold a single Secret", secretFile)
+	}
+	doc := file.Docs[0]
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	encryptedRegex := regexp.MustCompile(sopsEncryptedRegex)
+	mac := sha512.New()
+	err = walkSopsTree(doc, nil, func(value *yaml.Node, path []string) error {
+		valueType, plain, macBytes := sopsValue(value)
+		mac.Write(macBytes)
+		encrypted := false
+		for _, key := range path {
+			if encryptedRegex.MatchString(key) {
+				encrypted = true
+				break
+			}
+		}
+		if !encrypted || plain == "" {
+			return nil
+		}
+		encryptedValue, err := sopsEncrypt(dataKey, plain, valueType, strings.Join(path, ":")+":")
+		if err != nil {
+			return err
+		}
+		value.Value = encryptedValue
+		value.Tag = "!!str"
+		value.Style = 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	lastModified := time.Now().UTC().Format(time.RFC3339)
+	encryptedMac, err := sopsEncrypt(dataKey, fmt.Sprintf("%X", mac.Sum(nil)), "str", lastModified)
+	if err != nil {
+		return err
+	}
+	ageKeys, err := b.encryptDataKey(dataKey)
+	if err != nil {
+		return err
+	}
+	metadata, err := manifest.FromValue(sopsMetadata{
+		Age:            ageKeys,
+		LastModified:   lastModified,
+		Mac:            encryptedMac,
+		EncryptedRegex: sopsEncryptedRegex,
+		Version:        sopsVersion,
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Set(doc, "sops", metadata)
+
+	if err := common.EnsureDirectoryExists(filepath.Dir(outputFile)); err != nil {
+		return err
+	}
+	file.Path = outputFile
+	return file.Save()
+}
+
+// Configure enables SOPS decryption on the Flux Kustomization applying the
+// environment's apps directory
+func (b *sopsAgeBackend) Configure(env config.Environment) error {
+	return EnableSopsDecryption(env)
+}
+
+type sopsAgeKey struct {
+	Recipient string `yaml:"recipient"`
+	Enc       string `yaml:"enc"`
+}
+
+type sopsMetadata struct {
+	Age            []sopsAgeKey `yaml:"age"`
+	LastModified   string       `yaml:"lastmodified"`
+	Mac            string       `yaml:"mac"`
+	EncryptedRegex string       `yaml:"encrypted_regex"`
+	Version        string       `yaml:"version"`
+}
+
+// encryptDataKey encrypts the data key for every recipient separately, as sops does
+func (b *sopsAgeBackend) encryptDataKey(dataKey []byte) ([]sopsAgeKey, error) {
+	var keys []sopsAgeKey
+	for _, recipient := range b.recipients {
+		parsed, err := age.ParseX25519Recipient(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %s: %w", recipient, err)
+		}
+		var buffer bytes.Buffer
+		armored := armor.NewWriter(&buffer)
+		writer, err := age.Encrypt(armored, parsed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(dataKey); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		if err := armored.Close(); err != nil {
+			return nil, err
+		}
+		keys = append(keys, sopsAgeKey{Recipient: recipient, Enc: buffer.String()})
+	}
+	return keys, nil
+}
+
+// walkSopsTree calls fn for every scalar leaf of node with the mapping keys
+// leading to it
+func walkSopsTree(node *yaml.Node, path []string, fn func(value *yaml.Node, path []string) error) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := append(append([]string{}, path...), node.Content[i].Value)
+			if err := walkSopsTree(node.Content[i+1], keyPath, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := walkSopsTree(item, path, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		return fn(node, path)
+	}
+	return nil
+}
+
+// sopsValue returns the sops type of a scalar, the bytes that get encrypted and
+// the bytes that go into the MAC
+func sopsValue(value *yaml.Node) (string, string, []byte) {
+	switch value.ShortTag() {
+	case "!!int":
+		return "int", value.Value, []byte(value.Value)
+	case "!!float":
+		return "float", value.Value, []byte(value.Value)
+	case "!!bool":
+		if strings.EqualFold(value.Value, "true") {
+			return "bool", "true", []byte("True")
+		}
+		return "bool", "false", []byte("False")
+	default:
+		return "str", value.Value, []byte(value.Value)
+	}
+}
+
+// sopsEncrypt encrypts a value with AES256-GCM into the sops ENC[...] notation
+func sopsEncrypt(dataKey []byte, plain, valueType, additionalData string) (string, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, sopsNonceSize)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, sopsNonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	out := gcm.Seal(nil, iv, []byte(plain), []byte(additionalData))
+	tagStart := len(out) - gcm.Overhead()
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(out[:tagStart]),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(out[tagStart:]),
+		valueType), nil
+}
+
+// EnableSopsDecryption adds the sops decryption block to every Flux Kustomization
+// under config.ClusterPath whose path points at the environment's apps directory
+func EnableSopsDecryption(env config.Environment) error {
+	target := filepath.Join(config.AppTemplatePath, env.Name)
+	exists, err := common.CheckFileExists(config.ClusterPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no %s directory to look for the Flux Kustomization of ./%s", config.ClusterPath, target)
+	}
+	found := false
+	err = filepath.Walk(config.ClusterPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+			return nil
+		}
+		file, err := manifest.Load(path)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for _, doc := range file.Docs {
+			if manifest.Kind(doc) != "Kustomization" ||
+				!strings.HasPrefix(manifest.Scalar(doc, "apiVersion"), "kustomize.toolkit.fluxcd.io/") ||
+				filepath.Clean(manifest.Scalar(doc, "spec", "path")) != target {
+				continue
+			}
+			found = true
+			spec := manifest.Get(doc, "spec")
+			if manifest.Scalar(spec, "decryption", "provider") == "sops" &&
+				manifest.Scalar(spec, "decryption", "secretRef", "name") == env.SopsSecretName {
+				continue
+			}
+			decryption := manifest.Ensure(spec, "decryption")
+			manifest.SetScalar(decryption, "provider", "sops")
+			manifest.SetScalar(manifest.Ensure(decryption, "secretRef"), "name", env.SopsSecretName)
+			changed = true
+		}
+		if changed {
+			return file.Save()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no Flux Kustomization with path ./%s found under %s", target, config.ClusterPath)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"gopkg.in/yaml.v3"
+)
+
+var sopsValuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+// sopsDecrypt reverses sopsEncrypt the way sops does
+func sopsDecrypt(t *testing.T, dataKey []byte, value, additionalData string) string {
+	t.Helper()
+	match := sopsValuePattern.FindStringSubmatch(value)
+	if match == nil {
+		t.Fatalf("%q is not a sops value", value)
+	}
+	var parts [3][]byte
+	for i := range parts {
+		decoded, err := base64.StdEncoding.DecodeString(match[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[i] = decoded
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, sopsNonceSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := gcm.Open(nil, parts[1], append(parts[0], parts[2]...), []byte(additionalData))
+	if err != nil {
+		t.Fatalf("decrypting %s: %v", additionalData, err)
+	}
+	return string(plain)
+}
+
+func TestSopsEncryptRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret.yaml")
+	data := map[string]string{
+		"DB_PASSWORD": base64.StdEncoding.EncodeToString([]byte("s3cret")),
+		"PORT":        base64.StdEncoding.EncodeToString([]byte("5432")),
+	}
+	if err := os.WriteFile(secretFile, []byte(CreateSecretYaml("api-secrets", "staging", data)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := &sopsAgeBackend{recipients: []string{identity.Recipient().String()}}
+	outputFile := filepath.Join(dir, "api-secrets.sops.yaml")
+	if err := backend.Encrypt(secretFile, outputFile); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := manifest.Load(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := file.Docs[0]
+	if regex := manifest.Scalar(doc, "sops", "encrypted_regex"); regex != "^(data|stringData)$" {
+		t.Errorf("encrypted_regex is %q", regex)
+	}
+	if name := manifest.Scalar(doc, "metadata", "name"); name != "api-secrets" {
+		t.Errorf("metadata.name is %q, only data should be encrypted", name)
+	}
+
+	ageKeys := manifest.Get(doc, "sops", "age")
+	if ageKeys == nil || len(ageKeys.Content) != 1 {
+		t.Fatal("expected one age recipient")
+	}
+	reader, err := age.Decrypt(armor.NewReader(strings.NewReader(manifest.Scalar(ageKeys.Content[0], "enc"))), identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := manifest.Get(doc, "data")
+	if encrypted == nil || encrypted.Kind != yaml.MappingNode {
+		t.Fatal("encrypted file has no data")
+	}
+	for i := 0; i+1 < len(encrypted.Content); i += 2 {
+		key := encrypted.Content[i].Value
+		plain := sopsDecrypt(t, dataKey, encrypted.Content[i+1].Value, "data:"+key+":")
+		if plain != data[key] {
+			t.Errorf("%s: got %q, want %q", key, plain, data[key])
+		}
+	}
+	if len(encrypted.Content)/2 != len(data) {
+		t.Errorf("got %d data keys, want %d", len(encrypted.Content)/2, len(data))
+	}
+	sopsDecrypt(t, dataKey, manifest.Scalar(doc, "sops", "mac"), manifest.Scalar(doc, "sops", "lastmodified"))
+}
+
+func TestEnableSopsDecryptionRequiresClusters(t *testing.T) {
+	clusterPath := config.ClusterPath
+	defer func() { config.ClusterPath = clusterPath }()
+	config.ClusterPath = filepath.Join(t.TempDir(), "clusters")
+
+	env := config.Environment{Name: "staging", SopsSecretName: "sops-age"}
+	if err := EnableSopsDecryption(env); err == nil {
+		t.Fatal("expected an error without a clusters directory")
+	}
+
+	kustomization := filepath.Join(config.ClusterPath, "staging", "apps.yaml")
+	if err := os.MkdirAll(filepath.Dir(kustomization), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := "apiVersion: kustomize.toolkit.fluxcd.io/v1\nkind: Kustomization\nmetadata:\n  name: apps\nspec:\n  path: ./apps/staging\n"
+	if err := os.WriteFile(kustomization, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnableSopsDecryption(env); err != nil {
+		t.Fatal(err)
+	}
+	file, err := manifest.Load(kustomization)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider := manifest.Scalar(file.Docs[0], "spec", "decryption", "provider"); provider != "sops" {
+		t.Errorf("decryption provider is %q", provider)
+	}
+	if name := manifest.Scalar(file.Docs[0], "spec", "decryption", "secretRef", "name"); name != "sops-age" {
+		t.Errorf("decryption secretRef is %q", name)
+	}
+}
@@ -0,0 +1,385 @@
+package secret
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"gopkg.in/yaml.v3"
+)
+
+// SealedSecret holds the parts of a bitnami SealedSecret needed for auditing
+type SealedSecret struct {
+	ApiVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name        string            `yaml:"name"`
+		Namespace   string            `yaml:"namespace"`
+		Annotations map[string]string `yaml:"annotations"`
+	} `yaml:"metadata"`
+	Spec struct {
+		EncryptedData map[string]string `yaml:"encryptedData"`
+		Template      struct {
+			Metadata struct {
+				Name      string `yaml:"name"`
+				Namespace string `yaml:"namespace"`
+			} `yaml:"metadata"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+	// File is the manifest the sealed secret was read from
+	File string `yaml:"-"`
+}
+
+// SecretName returns the name of the Secret the controller will create
+func (s SealedSecret) SecretName() string {
+	if s.Spec.Template.Metadata.Name != "" {
+		return s.Spec.Template.Metadata.Name
+	}
+	return s.Metadata.Name
+}
+
+// Keys returns the sorted key names of the secret
+func (s SealedSecret) Keys() []string {
+	return sortedKeys(s.Spec.EncryptedData)
+}
+
+// Status is the result of comparing sealed secrets against their consumers
+type Status struct {
+	Secrets []SealedSecret
+	// Missing keys are referenced by a workload but not present in any sealed secret
+	Missing []string
+	// Orphaned keys are sealed but not referenced by any workload
+	Orphaned []string
+	// Extra keys are present in the local .env but not sealed
+	Extra []string
+}
+
+// HasDrift reports whether any missing, orphaned or extra keys were found
+func (s *Status) HasDrift() bool {
+	return len(s.Missing) > 0 || len(s.Orphaned) > 0 || len(s.Extra) > 0
+}
+
+// secretRefs collects the secret keys a workload consumes
+type secretRefs struct {
+	keys  map[string]map[string]bool // secret name -> keys
+	whole map[string]bool            // secrets consumed through envFrom
+}
+
+var workloadKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"Job":         true,
+	"CronJob":     true,
+}
+
+// CheckStatus compares the sealed secrets in appPath with the secret references
+// of the workloads in the same directory and, if envFile is set, with the keys of
+// a local .env file. The .env file is compared with every sealed secret unless
+// secretName is set. Nothing is decrypted, only key names are compared.
+func CheckStatus(appPath, envFile, secretName string) (*Status, error) {
+	sealed, err := FindEncryptedSecrets(appPath)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := findSecretRefs(appPath)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{Secrets: sealed}
+	sealedKeys := make(map[string]map[string]bool)
+	for _, s := range sealed {
+		name := s.SecretName()
+		if sealedKeys[name] == nil {
+			sealedKeys[name] = make(map[string]bool)
+		}
+		for key := range s.Spec.EncryptedData {
+			sealedKeys[name][key] = true
+		}
+	}
+
+	for name, keys := range refs.keys {
+		for key := range keys {
+			if !sealedKeys[name][key] {
+				status.Missing = append(status.Missing, name+"/"+key)
+			}
+		}
+	}
+	for name := range refs.whole {
+		if _, ok := sealedKeys[name]; !ok {
+			status.Missing = append(status.Missing, name+"/*")
+		}
+	}
+	for name, keys := range sealedKeys {
+		if refs.whole[name] {
+			continue
+		}
+		for key := range keys {
+			if !refs.keys[name][key] {
+				status.Orphaned = append(status.Orphaned, name+"/"+key)
+			}
+		}
+	}
+
+	if envFile != "" {
+		envMap, err := common.ParseEnvFile(envFile, true)
+		if err != nil {
+			return nil, err
+		}
+		for key := range envMap {
+			found := false
+			for name, keys := range sealedKeys {
+				if secretName != "" && name != secretName {
+					continue
+				}
+				if keys[key] {
+					found = true
+					break
+				}
+			}
+			if !found {
+				status.Extra = append(status.Extra, key)
+			}
+		}
+	}
+
+	sort.Strings(status.Missing)
+	sort.Strings(status.Orphaned)
+	sort.Strings(status.Extra)
+	return status, nil
+}
+
+// FindSealedSecrets returns every SealedSecret found in the yaml files under dir
+func FindSealedSecrets(dir string) ([]SealedSecret, error) {
+	var sealed []SealedSecret
+	err := walkManifests(dir, func(path string, doc []byte) error {
+		var s SealedSecret
+		if err := yaml.Unmarshal(doc, &s); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		if s.Kind == "SealedSecret" {
+			s.File = path
+			sealed = append(sealed, s)
+		}
+		return nil
+	})
+	return sealed, err
+}
+
+// findSopsSecrets returns the SOPS encrypted Secrets under dir. Their key names
+// are stored in clear, so they are reported like sealed secrets.
+func findSopsSecrets(dir string) ([]SealedSecret, error) {
+	var secrets []SealedSecret
+	err := walkManifests(dir, func(path string, doc []byte) error {
+		var s struct {
+			Kind     string `yaml:"kind"`
+			Metadata struct {
+				Name      string `yaml:"name"`
+				Namespace string `yaml:"namespace"`
+			} `yaml:"metadata"`
+			Data       map[string]string      `yaml:"data"`
+			StringData map[string]string      `yaml:"stringData"`
+			Sops       map[string]interface{} `yaml:"sops"`
+		}
+		if err := yaml.Unmarshal(doc, &s); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		if s.Kind != "Secret" || s.Sops == nil {
+			return nil
+		}
+		secret := SealedSecret{Kind: s.Kind, File: path}
+		secret.Metadata.Name = s.Metadata.Name
+		secret.Metadata.Namespace = s.Metadata.Namespace
+		secret.Spec.EncryptedData = make(map[string]string)
+		for key, value := range s.Data {
+			secret.Spec.EncryptedData[key] = value
+		}
+		for key, value := range s.StringData {
+			secret.Spec.EncryptedData[key] = value
+		}
+		secrets = append(secrets, secret)
+		return nil
+	})
+	return secrets, err
+}
+
+func findSecretRefs(dir string) (*secretRefs, error) {
+	refs := &secretRefs{
+		keys:  make(map[string]map[string]bool),
+		whole: make(map[string]bool),
+	}
+	err := walkManifests(dir, func(path string, doc []byte) error {
+		var manifest map[string]interface{}
+		if err := yaml.Unmarshal(doc, &manifest); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		kind, _ := manifest["kind"].(string)
+		if !workloadKinds[kind] {
+			return nil
+		}
+		for _, container := range podContainers(manifest) {
+			collectContainerRefs(container, refs)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// UndefinedSecrets returns the secrets the workloads of a rendered overlay
+// reference that the overlay does not define
+func UndefinedSecrets(rendered []byte) ([]string, error) {
+	refs := &secretRefs{
+		keys:  make(map[string]map[string]bool),
+		whole: make(map[string]bool),
+	}
+	defined := make(map[string]bool)
+	decoder := yaml.NewDecoder(bytes.NewReader(rendered))
+	for {
+		var manifest map[string]interface{}
+		err := decoder.Decode(&manifest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing rendered manifests: %w", err)
+		}
+		kind, _ := manifest["kind"].(string)
+		if kind == "Secret" || kind == "SealedSecret" {
+			metadata, _ := manifest["metadata"].(map[string]interface{})
+			if name, _ := metadata["name"].(string); name != "" {
+				defined[name] = true
+			}
+		}
+		if !workloadKinds[kind] {
+			continue
+		}
+		for _, container := range podContainers(manifest) {
+			collectContainerRefs(container, refs)
+		}
+	}
+	var undefined []string
+	for name := range refs.keys {
+		if !defined[name] {
+			undefined = append(undefined, name)
+		}
+	}
+	for name := range refs.whole {
+		if !defined[name] && refs.keys[name] == nil {
+			undefined = append(undefined, name)
+		}
+	}
+	sort.Strings(undefined)
+	return undefined, nil
+}
+
+// podContainers returns the containers and init containers of a workload manifest
+func podContainers(manifest map[string]interface{}) []map[string]interface{} {
+	spec, _ := manifest["spec"].(map[string]interface{})
+	if manifest["kind"] == "CronJob" {
+		jobTemplate, _ := spec["jobTemplate"].(map[string]interface{})
+		spec, _ = jobTemplate["spec"].(map[string]interface{})
+	}
+	template, _ := spec["template"].(map[string]interface{})
+	podSpec, _ := template["spec"].(map[string]interface{})
+
+	var containers []map[string]interface{}
+	for _, field := range []string{"initContainers", "containers"} {
+		list, _ := podSpec[field].([]interface{})
+		for _, item := range list {
+			if container, ok := item.(map[string]interface{}); ok {
+				containers = append(containers, container)
+			}
+		}
+	}
+	return containers
+}
+
+func collectContainerRefs(container map[string]interface{}, refs *secretRefs) {
+	env, _ := container["env"].([]interface{})
+	for _, item := range env {
+		envVar, _ := item.(map[string]interface{})
+		valueFrom, _ := envVar["valueFrom"].(map[string]interface{})
+		keyRef, ok := valueFrom["secretKeyRef"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := keyRef["name"].(string)
+		key, _ := keyRef["key"].(string)
+		if refs.keys[name] == nil {
+			refs.keys[name] = make(map[string]bool)
+		}
+		refs.keys[name][key] = true
+	}
+	envFrom, _ := container["envFrom"].([]interface{})
+	for _, item := range envFrom {
+		source, _ := item.(map[string]interface{})
+		secretRef, ok := source["secretRef"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := secretRef["name"].(string); name != "" {
+			refs.whole[name] = true
+		}
+	}
+}
+
+// walkManifests calls fn for every yaml document found under dir
+func walkManifests(dir string, fn func(path string, doc []byte) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		for {
+			var doc interface{}
+			err := decoder.Decode(&doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error parsing %s: %w", path, err)
+			}
+			if doc == nil {
+				continue
+			}
+			out, err := yaml.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			if err := fn(path, out); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FindEncryptedSecrets returns the sealed and SOPS encrypted secrets under dir
+func FindEncryptedSecrets(dir string) ([]SealedSecret, error) {
+	sealed, err := FindSealedSecrets(dir)
+	if err != nil {
+		return nil, err
+	}
+	sops, err := findSopsSecrets(dir)
+	if err != nil {
+		return nil, err
+	}
+	return append(sealed, sops...), nil
+}
@@ -9,6 +9,10 @@ import (
 )
 
 const portFilePath = "ports.txt"
+
+// PortFile is the registry of the ports claimed by apps
+const PortFile = portFilePath
+
 const minPort = 8000
 const maxPort = 9000
 
@@ -21,7 +25,11 @@ func IsPortUsed(port int) bool {
     defer file.Close()
     scanner := bufio.NewScanner(file)
     for scanner.Scan() {
-		usedPort, _ := strconv.Atoi(strings.TrimSpace(strings.Split(scanner.Text(), ":")[1]))
+        parts := strings.SplitN(scanner.Text(), ":", 2)
+        if len(parts) != 2 {
+            continue
+        }
+        usedPort, _ := strconv.Atoi(strings.TrimSpace(parts[1]))
         if usedPort == port {
             return true
         }
@@ -56,7 +64,7 @@ func RemovePort(appName string, port int) error {
     lines := strings.Split(string(file), "\n")
     var newLines []string
     for _, line := range lines {
-        if line != fmt.Sprintf("%s: %d\n", appName, port) || line  != fmt.Sprintf("%s:%d\n", appName, port){
+        if line != fmt.Sprintf("%s: %d", appName, port) && line != fmt.Sprintf("%s:%d", appName, port) {
             newLines = append(newLines, line)
         }
     }
@@ -64,6 +72,67 @@ func RemovePort(appName string, port int) error {
     return os.WriteFile(portFilePath, []byte(strings.Join(newLines, "\n")), 0644)
 }
 
+// Get the port registered for an app, 0 when it has none
+func GetPort(appName string) int {
+    file, err := os.Open(portFilePath)
+    if err != nil {
+        return 0
+    }
+    defer file.Close()
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        parts := strings.SplitN(scanner.Text(), ":", 2)
+        if len(parts) == 2 && strings.TrimSpace(parts[0]) == appName {
+            port, _ := strconv.Atoi(strings.TrimSpace(parts[1]))
+            return port
+        }
+    }
+    return 0
+}
+
+// Get the registered ports by app name
+func Ports() (map[string]int, error) {
+    ports := make(map[string]int)
+    file, err := os.Open(portFilePath)
+    if os.IsNotExist(err) {
+        return ports, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        parts := strings.SplitN(scanner.Text(), ":", 2)
+        if len(parts) != 2 {
+            continue
+        }
+        port, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+        if err != nil {
+            continue
+        }
+        ports[strings.TrimSpace(parts[0])] = port
+    }
+    return ports, scanner.Err()
+}
+
+// Move an app to a new port
+func UpdatePort(appName string, port int) error {
+    current := GetPort(appName)
+    if current == port {
+        return nil
+    }
+    if IsPortUsed(port) {
+        return fmt.Errorf("port %d is already used", port)
+    }
+    if current != 0 {
+        if err := RemovePort(appName, current); err != nil {
+            return err
+        }
+    }
+    return AddPort(appName, port)
+}
+
 
 // Allocate a new port
 func AllocatePort(appName string) (int, error) {
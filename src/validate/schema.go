@@ -0,0 +1,454 @@
+package validate
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed schemas/*.yaml
+var schemaFiles embed.FS
+
+// Schema is the subset of an OpenAPI v3 schema the bundled schemas use
+type Schema struct {
+	Type                 string               `yaml:"type"`
+	Required             []string             `yaml:"required"`
+	Properties           map[string]*Schema   `yaml:"properties"`
+	Items                *Schema              `yaml:"items"`
+	AdditionalProperties additionalProperties `yaml:"additionalProperties"`
+	Enum                 []string             `yaml:"enum"`
+	Pattern              string               `yaml:"pattern"`
+	// Format quantity accepts numbers as well as strings matching Pattern
+	Format string `yaml:"format"`
+	// Ref names a shared definition, it replaces the rest of the schema
+	Ref             string `yaml:"$ref"`
+	IntOrString     bool   `yaml:"x-kubernetes-int-or-string"`
+	PreserveUnknown bool   `yaml:"x-kubernetes-preserve-unknown-fields"`
+	MinItems        int    `yaml:"minItems"`
+	// AnyOf holds alternatives of which an object must match at least one,
+	// like the rules or defaultBackend an Ingress needs
+	AnyOf []*Schema `yaml:"anyOf"`
+
+	pattern *regexp.Regexp
+}
+
+// additionalProperties is either false, which closes the object, or the
+// schema of the fields not listed in properties
+type additionalProperties struct {
+	Closed bool
+	Schema *Schema
+}
+
+func (a *additionalProperties) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!bool" {
+		var allowed bool
+		if err := node.Decode(&allowed); err != nil {
+			return err
+		}
+		a.Closed = !allowed
+		return nil
+	}
+	a.Schema = &Schema{}
+	return node.Decode(a.Schema)
+}
+
+type schemaFile struct {
+	Definitions map[string]*Schema `yaml:"definitions"`
+	Kinds       []struct {
+		APIVersion string  `yaml:"apiVersion"`
+		Kind       string  `yaml:"kind"`
+		Schema     *Schema `yaml:"schema"`
+	} `yaml:"kinds"`
+}
+
+// Schemas holds the bundled schemas by apiVersion and kind
+type Schemas struct {
+	definitions map[string]*Schema
+	kinds       map[string]*Schema
+}
+
+// LoadSchemas reads the bundled schemas and resolves their references
+func LoadSchemas() (*Schemas, error) {
+	schemas := &Schemas{definitions: make(map[string]*Schema), kinds: make(map[string]*Schema)}
+	files, err := fs.Glob(schemaFiles, "schemas/*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		data, err := schemaFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var file schemaFile
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("error parsing schema %s: %w", name, err)
+		}
+		for definition, schema := range file.Definitions {
+			schemas.definitions[definition] = schema
+		}
+		for _, kind := range file.Kinds {
+			schemas.kinds[kindKey(kind.APIVersion, kind.Kind)] = kind.Schema
+		}
+	}
+	for definition, schema := range schemas.definitions {
+		if err := schemas.compile(schema); err != nil {
+			return nil, fmt.Errorf("definition %s: %w", definition, err)
+		}
+	}
+	for kind, schema := range schemas.kinds {
+		if err := schemas.compile(schema); err != nil {
+			return nil, fmt.Errorf("schema of %s: %w", kind, err)
+		}
+	}
+	return schemas, nil
+}
+
+// Lookup returns the schema of a kind, or nil when none is bundled
+func (s *Schemas) Lookup(apiVersion, kind string) *Schema {
+	return s.kinds[kindKey(apiVersion, kind)]
+}
+
+func kindKey(apiVersion, kind string) string {
+	return apiVersion + " " + kind
+}
+
+// compile checks the references and compiles the patterns of a schema tree
+func (s *Schemas) compile(schema *Schema) error {
+	if schema == nil {
+		return nil
+	}
+	if schema.Ref != "" {
+		if _, ok := s.definitions[schema.Ref]; !ok {
+			return fmt.Errorf("unknown definition %s", schema.Ref)
+		}
+		return nil
+	}
+	if schema.Pattern != "" && schema.pattern == nil {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return err
+		}
+		schema.pattern = pattern
+	}
+	for _, property := range schema.Properties {
+		if err := s.compile(property); err != nil {
+			return err
+		}
+	}
+	if err := s.compile(schema.Items); err != nil {
+		return err
+	}
+	for _, alternative := range schema.AnyOf {
+		if err := s.compile(alternative); err != nil {
+			return err
+		}
+	}
+	return s.compile(schema.AdditionalProperties.Schema)
+}
+
+func (s *Schemas) resolve(schema *Schema) *Schema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.definitions[schema.Ref]
+	}
+	return schema
+}
+
+// nodeTypes maps yaml tags to the schema type names
+var nodeTypes = map[string]string{
+	"!!map":   "object",
+	"!!seq":   "array",
+	"!!str":   "string",
+	"!!int":   "integer",
+	"!!float": "number",
+	"!!bool":  "boolean",
+	"!!null":  "null",
+}
+
+// checker validates the nodes of one document
+type checker struct {
+	schemas *Schemas
+	file    string
+	// partial documents are patches, their required fields come from the base
+	partial bool
+	issues  []Issue
+}
+
+func (c *checker) report(node *yaml.Node, path, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if path != "" {
+		message = path + ": " + message
+	}
+	c.issues = append(c.issues, Issue{File: c.file, Line: node.Line, Message: message})
+}
+
+func (c *checker) check(node *yaml.Node, schema *Schema, path string) {
+	schema = c.schemas.resolve(schema)
+	if schema == nil || schema.PreserveUnknown {
+		return
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return
+	}
+	if schema.Format == "quantity" {
+		switch node.Tag {
+		case "!!int", "!!float":
+		case "!!str":
+			c.checkString(node, schema, path)
+		default:
+			c.report(node, path, "expected quantity, got %s", typeName(node))
+		}
+		return
+	}
+	if schema.IntOrString {
+		switch node.Tag {
+		case "!!int":
+		case "!!str":
+			c.checkString(node, schema, path)
+		default:
+			c.report(node, path, "expected integer or string, got %s", typeName(node))
+		}
+		return
+	}
+
+	switch schema.Type {
+	case "object":
+		if node.Kind != yaml.MappingNode {
+			c.report(node, path, "expected object, got %s", typeName(node))
+			return
+		}
+		c.checkObject(node, schema, path)
+	case "array":
+		if node.Kind != yaml.SequenceNode {
+			c.report(node, path, "expected array, got %s", typeName(node))
+			return
+		}
+		if len(node.Content) < schema.MinItems {
+			c.report(node, path, "needs at least %d items", schema.MinItems)
+		}
+		for i, item := range node.Content {
+			c.check(item, schema.Items, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case "string":
+		if node.Tag != "!!str" {
+			c.report(node, path, "expected string, got %s", typeName(node))
+			return
+		}
+		c.checkString(node, schema, path)
+	case "integer":
+		if node.Tag != "!!int" {
+			c.report(node, path, "expected integer, got %s", typeName(node))
+		}
+	case "number":
+		if node.Tag != "!!int" && node.Tag != "!!float" {
+			c.report(node, path, "expected number, got %s", typeName(node))
+		}
+	case "boolean":
+		if node.Tag != "!!bool" {
+			c.report(node, path, "expected boolean, got %s", typeName(node))
+		}
+	default:
+		if node.Kind == yaml.MappingNode {
+			c.checkObject(node, schema, path)
+		}
+	}
+}
+
+func (c *checker) checkObject(node *yaml.Node, schema *Schema, path string) {
+	seen := make(map[string]bool, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		field := key.Value
+		if path != "" {
+			field = path + "." + key.Value
+		}
+		if seen[key.Value] {
+			c.report(key, field, "duplicate field")
+			continue
+		}
+		seen[key.Value] = true
+		if property, ok := schema.Properties[key.Value]; ok {
+			c.check(value, property, field)
+			continue
+		}
+		if schema.AdditionalProperties.Schema != nil {
+			c.check(value, schema.AdditionalProperties.Schema, field)
+			continue
+		}
+		// strategic merge directives like $patch are only valid in patches
+		if schema.AdditionalProperties.Closed && !(c.partial && strings.HasPrefix(key.Value, "$")) {
+			c.report(key, field, "unknown field")
+		}
+	}
+	if c.partial {
+		return
+	}
+	for _, required := range schema.Required {
+		if !seen[required] {
+			field := required
+			if path != "" {
+				field = path + "." + required
+			}
+			c.report(node, field, "required field is missing")
+		}
+	}
+	if len(schema.AnyOf) > 0 && !c.matchesAny(node, schema.AnyOf, path) {
+		var alternatives []string
+		for _, alternative := range schema.AnyOf {
+			alternatives = append(alternatives, strings.Join(alternative.Required, " and "))
+		}
+		c.report(node, path, "needs %s", strings.Join(alternatives, " or "))
+	}
+}
+
+// matchesAny reports whether node matches one of the alternatives
+func (c *checker) matchesAny(node *yaml.Node, alternatives []*Schema, path string) bool {
+	for _, alternative := range alternatives {
+		sub := &checker{schemas: c.schemas, file: c.file}
+		sub.check(node, alternative, path)
+		if len(sub.issues) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checker) checkString(node *yaml.Node, schema *Schema, path string) {
+	if len(schema.Enum) > 0 {
+		valid := false
+		for _, value := range schema.Enum {
+			if node.Value == value {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			c.report(node, path, "%q is not one of %s", node.Value, strings.Join(schema.Enum, ", "))
+		}
+	}
+	switch {
+	case schema.pattern == nil || schema.pattern.MatchString(node.Value):
+	case schema.Format != "":
+		c.report(node, path, "%q is not a valid %s", node.Value, schema.Format)
+	default:
+		c.report(node, path, "%q does not match %s", node.Value, schema.Pattern)
+	}
+}
+
+func typeName(node *yaml.Node) string {
+	if name, ok := nodeTypes[node.Tag]; ok {
+		return name
+	}
+	return node.Tag
+}
+
+// Field is a field the bundled schema of a kind checks
+type Field struct {
+	Path     string
+	Type     string
+	Required bool
+}
+
+// Kinds returns the apiVersion and kind of every bundled schema, sorted
+func (s *Schemas) Kinds() []string {
+	var kinds []string
+	for kind := range s.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Fields lists every field checked for a kind returned by Kinds. Fields of an
+// object described as "other fields unchecked" are accepted as they are.
+func (s *Schemas) Fields(kind string) []Field {
+	var fields []Field
+	s.collectFields(s.kinds[kind], "", false, map[string]bool{}, &fields)
+	return fields
+}
+
+func (s *Schemas) collectFields(schema *Schema, path string, required bool, refs map[string]bool, fields *[]Field) {
+	if schema != nil && schema.Ref != "" {
+		// definitions may refer to themselves, like JSON schema props do
+		if refs[schema.Ref] {
+			*fields = append(*fields, Field{Path: path, Type: "same as the enclosing " + schema.Ref, Required: required})
+			return
+		}
+		refs[schema.Ref] = true
+		defer delete(refs, schema.Ref)
+		schema = s.resolve(schema)
+	}
+	if schema == nil {
+		return
+	}
+	if path != "" {
+		*fields = append(*fields, Field{Path: path, Type: describeType(schema), Required: required})
+	}
+	prefix := path
+	if prefix != "" {
+		prefix += "."
+	}
+	var names []string
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		isRequired := false
+		for _, field := range schema.Required {
+			isRequired = isRequired || field == name
+		}
+		s.collectFields(schema.Properties[name], prefix+name, isRequired, refs, fields)
+	}
+	if schema.Items != nil {
+		s.collectFields(schema.Items, path+"[]", false, refs, fields)
+	}
+	if schema.AdditionalProperties.Schema != nil {
+		s.collectFields(schema.AdditionalProperties.Schema, prefix+"*", false, refs, fields)
+	}
+}
+
+func describeType(schema *Schema) string {
+	switch {
+	case schema.PreserveUnknown:
+		return "any, unchecked"
+	case schema.Format == "quantity":
+		return "quantity"
+	case schema.IntOrString:
+		return "integer or string"
+	}
+	object := schema.Type == "object" || schema.Type == "" && (len(schema.Properties) > 0 || schema.AdditionalProperties.Closed || schema.AdditionalProperties.Schema != nil)
+	description := schema.Type
+	switch {
+	case object:
+		description = "object"
+	case description == "":
+		description = "any"
+	}
+	if len(schema.Enum) > 0 {
+		description += " (" + strings.Join(schema.Enum, "|") + ")"
+	} else if schema.Pattern != "" {
+		description += " matching " + schema.Pattern
+	}
+	if schema.MinItems > 0 {
+		description += fmt.Sprintf(", at least %d items", schema.MinItems)
+	}
+	if len(schema.AnyOf) > 0 {
+		var alternatives []string
+		for _, alternative := range schema.AnyOf {
+			alternatives = append(alternatives, strings.Join(alternative.Required, " and "))
+		}
+		description += ", needs " + strings.Join(alternatives, " or ")
+	}
+	if object && !schema.AdditionalProperties.Closed && schema.AdditionalProperties.Schema == nil {
+		description += ", other fields unchecked"
+	}
+	return description
+}
@@ -0,0 +1,322 @@
+package validate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/africhild/fleet-infra/src/common"
+	"github.com/africhild/fleet-infra/src/config"
+	"github.com/africhild/fleet-infra/src/manifest"
+	"github.com/africhild/fleet-infra/src/render"
+	"gopkg.in/yaml.v3"
+)
+
+// Issue is a problem found in a manifest
+type Issue struct {
+	File    string
+	Line    int
+	Message string
+	// Warning issues do not fail the validation
+	Warning bool
+}
+
+func (i Issue) String() string {
+	location := i.File
+	if i.Line > 0 {
+		location = fmt.Sprintf("%s:%d", i.File, i.Line)
+	}
+	if i.Warning {
+		return fmt.Sprintf("%s: warning: %s", location, i.Message)
+	}
+	return fmt.Sprintf("%s: %s", location, i.Message)
+}
+
+// Result is the outcome of a validation
+type Result struct {
+	Files     int
+	Documents int
+	Issues    []Issue
+}
+
+// Errors returns the number of issues that fail the validation
+func (r *Result) Errors() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Warning {
+			n++
+		}
+	}
+	return n
+}
+
+// Warnings returns the number of issues that do not fail the validation
+func (r *Result) Warnings() int {
+	return len(r.Issues) - r.Errors()
+}
+
+// DefaultPaths are the directories validated when no path is given
+func DefaultPaths() []string {
+	return []string{config.AppTemplatePath, "infrastructure", config.ClusterPath}
+}
+
+// kustomizationFiles are the names kustomize looks for in a directory
+var kustomizationFiles = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// yamlLinePattern finds the line in yaml syntax errors
+var yamlLinePattern = regexp.MustCompile(`line (\d+)`)
+
+// Paths validates every manifest below the given files and directories,
+// missing paths are skipped
+func Paths(paths []string) (*Result, error) {
+	schemas, err := LoadSchemas()
+	if err != nil {
+		return nil, err
+	}
+	files, err := findManifests(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	parsed := make(map[string]*manifest.File, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := parseManifest(file, data)
+		if err != nil {
+			line := 0
+			if match := yamlLinePattern.FindStringSubmatch(err.Error()); match != nil {
+				line, _ = strconv.Atoi(match[1])
+			}
+			result.Issues = append(result.Issues, Issue{File: file, Line: line, Message: err.Error()})
+			continue
+		}
+		parsed[file] = docs
+	}
+
+	// kustomizations tell which files are patches and which are generator
+	// sources, so they are checked first
+	patches := make(map[string]bool)
+	sources := make(map[string]bool)
+	for _, file := range files {
+		if docs, ok := parsed[file]; ok && isKustomizationFile(file) {
+			for _, doc := range docs.Docs {
+				result.Issues = append(result.Issues, checkKustomization(file, doc, patches, sources)...)
+			}
+		}
+	}
+
+	for _, file := range files {
+		docs, ok := parsed[file]
+		if !ok || sources[filepath.Clean(file)] {
+			continue
+		}
+		result.Files++
+		for _, doc := range docs.Docs {
+			result.Documents++
+			result.Issues = append(result.Issues, checkDocument(schemas, file, doc, patches[filepath.Clean(file)])...)
+		}
+	}
+	return result, nil
+}
+
+// parseManifest decodes the documents of a manifest keeping their lines
+func parseManifest(path string, data []byte) (*manifest.File, error) {
+	file := &manifest.File{Path: path}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return file, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(doc.Content) > 0 && doc.Content[0].Kind != yaml.ScalarNode {
+			file.Docs = append(file.Docs, doc.Content[0])
+		}
+	}
+}
+
+// findManifests returns the yaml files below paths, hidden directories are
+// skipped
+func findManifests(paths []string) ([]string, error) {
+	var files []string
+	for _, root := range paths {
+		exists, err := common.CheckFileExists(root)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != root && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" || d.Name() == "Kustomization" {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func isKustomizationFile(path string) bool {
+	for _, name := range kustomizationFiles {
+		if filepath.Base(path) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDocument validates a document against the schema of its kind
+func checkDocument(schemas *Schemas, file string, doc *yaml.Node, partial bool) []Issue {
+	apiVersion := manifest.Scalar(doc, "apiVersion")
+	kind := manifest.Kind(doc)
+	if isKustomizationFile(file) && apiVersion == "" && kind == "" {
+		// kustomize assumes the kind of kustomization files
+		apiVersion, kind = "kustomize.config.k8s.io/v1beta1", "Kustomization"
+	}
+	if apiVersion == "" || kind == "" {
+		return []Issue{{File: file, Line: doc.Line, Message: "apiVersion and kind are required"}}
+	}
+	schema := schemas.Lookup(apiVersion, kind)
+	if schema == nil {
+		return []Issue{{File: file, Line: doc.Line, Message: fmt.Sprintf("no schema for %s %s, not validated", apiVersion, kind), Warning: true}}
+	}
+	c := &checker{schemas: schemas, file: file, partial: partial}
+	c.check(doc, schema, "")
+	if apiVersion == "kustomize.toolkit.fluxcd.io/v1" && kind == "Kustomization" {
+		c.issues = append(c.issues, checkFluxPath(file, doc)...)
+	}
+	return c.issues
+}
+
+// checkFluxPath checks that a Flux Kustomization reading this repository points
+// at a directory that exists, paths are relative to the repository root
+func checkFluxPath(file string, doc *yaml.Node) []Issue {
+	path := manifest.Get(doc, "spec", "path")
+	if path == nil || manifest.Scalar(doc, "spec", "sourceRef", "name") != "flux-system" {
+		return nil
+	}
+	exists, err := common.CheckFileExists(filepath.Clean(path.Value))
+	if err != nil || !exists {
+		return []Issue{{File: file, Line: path.Line, Message: fmt.Sprintf("spec.path: %s does not exist", path.Value)}}
+	}
+	return nil
+}
+
+// checkKustomization checks that the paths a kustomization refers to exist and
+// records its patches and generator sources
+func checkKustomization(file string, doc *yaml.Node, patches, sources map[string]bool) []Issue {
+	dir := filepath.Dir(file)
+	var issues []Issue
+	missing := func(node *yaml.Node, field, path string) {
+		issues = append(issues, Issue{File: file, Line: node.Line, Message: fmt.Sprintf("%s: %s does not exist", field, path)})
+	}
+	items := func(field string) []*yaml.Node {
+		list := manifest.Get(doc, field)
+		if list == nil || list.Kind != yaml.SequenceNode {
+			return nil
+		}
+		return list.Content
+	}
+
+	for _, field := range []string{"resources", "components"} {
+		for _, item := range items(field) {
+			if item.Kind != yaml.ScalarNode || isRemote(item.Value) {
+				continue
+			}
+			path := filepath.Join(dir, item.Value)
+			info, err := os.Stat(path)
+			if err != nil {
+				missing(item, field, item.Value)
+				continue
+			}
+			if info.IsDir() && !render.HasKustomization(path) {
+				issues = append(issues, Issue{File: file, Line: item.Line, Message: fmt.Sprintf("%s: %s has no kustomization", field, item.Value)})
+			}
+		}
+	}
+	checkFile := func(node *yaml.Node, field string, record map[string]bool) {
+		if node == nil || node.Kind != yaml.ScalarNode {
+			return
+		}
+		path := filepath.Join(dir, node.Value)
+		if exists, err := common.CheckFileExists(path); err != nil || !exists {
+			missing(node, field, node.Value)
+			return
+		}
+		record[filepath.Clean(path)] = true
+	}
+	for _, item := range items("patches") {
+		checkFile(manifest.Get(item, "path"), "patches", patches)
+	}
+	for _, item := range items("patchesStrategicMerge") {
+		checkFile(item, "patchesStrategicMerge", patches)
+	}
+	for _, field := range []string{"configMapGenerator", "secretGenerator"} {
+		for _, generator := range items(field) {
+			if envs := manifest.Get(generator, "envs"); envs != nil {
+				for _, env := range envs.Content {
+					checkFile(env, field, sources)
+				}
+			}
+			if envFile := manifest.Get(generator, "env"); envFile != nil {
+				checkFile(envFile, field, sources)
+			}
+			files := manifest.Get(generator, "files")
+			if files == nil {
+				continue
+			}
+			for _, source := range files.Content {
+				// a source is path or key=path, a directory adds every file in it
+				value := *source
+				if i := strings.Index(value.Value, "="); i >= 0 {
+					value.Value = value.Value[i+1:]
+				}
+				checkFile(&value, field, sources)
+				recordDirectory(filepath.Join(dir, value.Value), sources)
+			}
+		}
+	}
+	return issues
+}
+
+// recordDirectory marks every file below a generator source directory
+func recordDirectory(path string, sources map[string]bool) {
+	filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			sources[filepath.Clean(file)] = true
+		}
+		return nil
+	})
+}
+
+// isRemote reports whether a kustomize resource is fetched from a repository
+func isRemote(resource string) bool {
+	return strings.Contains(resource, "://") || strings.HasPrefix(resource, "github.com/") || strings.HasPrefix(resource, "git@")
+}